@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const topCacheKeys = 20
+
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Limit     int64  `json:"limit"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type CacheKeyStats struct {
+	Key   string `json:"key"`
+	Hits  uint64 `json:"hits"`
+	Bytes int    `json:"bytes"`
+}
+
+type CacheStatsResponse struct {
+	Memory  CacheStats      `json:"memory"`
+	Disk    CacheStats      `json:"disk"`
+	TopKeys []CacheKeyStats `json:"top_keys"`
+}
+
+type CachePurgeResponse struct {
+	Memory int `json:"memory"`
+	Disk   int `json:"disk"`
+}
+
+// Checks the admin token given as bearer token or URL query "token". Admin endpoints are disabled
+// if no token is configured.
+func checkAdminAccess(resp http.ResponseWriter, req *http.Request) bool {
+	if g_config.AdminToken == "" {
+		http.NotFound(resp, req)
+		return false
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(g_config.AdminToken)) != 1 {
+		http.Error(resp, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func getCacheStats() CacheStatsResponse {
+	var res CacheStatsResponse
+
+	Cache.Mutex.Lock()
+
+	res.Memory = CacheStats{Entries: len(Cache.Cache), Bytes: Cache.CacheSize, Limit: Cache.CacheSizeLimit,
+		Hits: Cache.Hits, Misses: Cache.Misses, Evictions: Cache.Evictions}
+
+	res.TopKeys = make([]CacheKeyStats, 0, len(Cache.Cache))
+	for elem := Cache.Lru.Front(); elem != nil; elem = elem.Next() {
+		ent := elem.Value.(*ImageCacheEntry)
+		res.TopKeys = append(res.TopKeys, CacheKeyStats{Key: ent.key, Hits: ent.hits, Bytes: len(ent.image)})
+	}
+
+	Cache.Mutex.Unlock()
+
+	sort.SliceStable(res.TopKeys, func(a, b int) bool { return res.TopKeys[a].Hits > res.TopKeys[b].Hits })
+
+	if len(res.TopKeys) > topCacheKeys {
+		res.TopKeys = res.TopKeys[:topCacheKeys]
+	}
+
+	c := &ImageDiskCache
+
+	c.Mutex.Lock()
+	res.Disk = CacheStats{Entries: len(c.Cache), Bytes: c.CacheSize, Limit: c.CacheSizeLimit,
+		Hits: c.Hits, Misses: c.Misses, Evictions: c.Evictions}
+	c.Mutex.Unlock()
+
+	return res
+}
+
+// Returns cache statistics (GET) or purges the caches (DELETE). The URL query "file" restricts
+// purging to the renditions of a single repository file.
+func handleAdminCacheRequest(resp http.ResponseWriter, req *http.Request) {
+	if !checkAdminAccess(resp, req) {
+		return
+	}
+
+	var res interface{}
+
+	switch req.Method {
+	case http.MethodGet:
+		res = getCacheStats()
+
+	case http.MethodDelete:
+		file := req.URL.Query().Get("file")
+		res = CachePurgeResponse{Memory: purgeImageCache(file), Disk: purgeDiskCache(file)}
+
+	default:
+		resp.Header().Set("Allow", "GET, DELETE")
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp.Header().Set("Cache-Control", jsonCacheControl)
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+
+	d, err := json.Marshal(res)
+	if err != nil {
+		Error("handleAdminCacheRequest: marshal: %v\n", err)
+	}
+
+	writeCompressed(resp, req, d)
+}
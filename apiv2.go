@@ -0,0 +1,238 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const ApiV2UrlRoot = "/api/v2/"
+
+const ZoneContent = "content"
+const ZoneContent2 = "content2"
+const ZoneContent3 = "content3"
+const ZoneMixin = "mixin"
+const ZoneTicker = "ticker"
+const ZoneTickerDefault = "ticker_default"
+
+//go:embed openapi.json
+var openApiSpec []byte
+
+// Item types of the v2 API for the content types of the v1 API.
+var zoneItemTypes = map[string]string{
+	ContentTypeImage: "image",
+	ContentTypeVideo: "video",
+	ContentTypeText:  "text",
+	ContentTypeHtml:  "html",
+}
+
+type ZoneItemSchedule struct {
+	Start string `json:"start,omitempty"`
+	End string `json:"end,omitempty"`
+}
+
+type ZoneItem struct {
+	Type string `json:"type"`
+	Url string `json:"url,omitempty"`
+	Text string `json:"text,omitempty"`
+	Duration uint `json:"duration,omitempty"`
+	Schedule *ZoneItemSchedule `json:"schedule,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type Zone struct {
+	Name string `json:"name"`
+	Items []ZoneItem `json:"items"`
+}
+
+type ContentV2Response struct {
+	Revision int64 `json:"revision"`
+	Zones []Zone `json:"zones"`
+}
+
+type ZoneConfig struct {
+	Name string `json:"name"`
+	Duration uint `json:"duration"`
+}
+
+type WeatherConfig struct {
+	Url string `json:"url"`
+	ApiKey string `json:"api_key"`
+	CityId string `json:"city_id"`
+}
+
+type ConfigV2Response struct {
+	ScreenConfig uint `json:"screen_config"`
+	Zones []ZoneConfig `json:"zones"`
+	MixinRate uint `json:"mixin_rate"`
+	MaxVideoDuration uint `json:"max_video_duration"`
+	VideoExtensions []string `json:"video_extensions"`
+	Weather WeatherConfig `json:"weather"`
+}
+
+// Returns the default display duration of items of a zone in seconds.
+func zoneDuration(server *Server, zone string) uint {
+	switch zone {
+	case ZoneContent, ZoneContent2, ZoneContent3:
+		return server.config.ContentImageDisplayDuration
+	case ZoneMixin:
+		return server.config.MixinImageDisplayDuration
+	case ZoneTicker, ZoneTickerDefault:
+		return server.config.TickerDisplayDuration
+	}
+
+	return 0
+}
+
+func buildZoneItem(c Content, defaultDuration uint) ZoneItem {
+	item := ZoneItem{Type: zoneItemTypes[c.Type], Text: c.Text, Duration: c.Duration}
+
+	if c.RepoUrl != "" {
+		item.Url = RepUrlRoot + c.RepoUrl
+	}
+
+	// videos are played until their end unless a duration is given explicitly
+	if item.Duration == 0 && c.Type != ContentTypeVideo {
+		item.Duration = defaultDuration
+	}
+
+	if c.Start != "" || c.End != "" {
+		item.Schedule = &ZoneItemSchedule{Start: c.Start, End: c.End}
+	}
+
+	item.Metadata = make(map[string]string)
+
+	if c.QrUrl != "" {
+		item.Metadata["qr_url"] = RepUrlRoot + c.QrUrl
+	}
+
+	if c.Width > 0 && c.Height > 0 {
+		item.Metadata["width"] = strconv.Itoa(c.Width)
+		item.Metadata["height"] = strconv.Itoa(c.Height)
+	}
+
+	if c.Size > 0 {
+		item.Metadata["size"] = strconv.FormatInt(c.Size, 10)
+	}
+
+	if c.SourceFile != "" {
+		item.Metadata["source_file"] = c.SourceFile
+	}
+
+	if c.SourceModTime != "" {
+		item.Metadata["source_mtime"] = c.SourceModTime
+	}
+
+	if c.Hash != "" {
+		item.Metadata["hash"] = c.Hash
+	}
+
+	if c.PosterUrl != "" {
+		item.Metadata["poster_url"] = RepUrlRoot + c.PosterUrl
+	}
+
+	if c.BlurHash != "" {
+		item.Metadata["blurhash"] = c.BlurHash
+	}
+
+	if c.Color != "" {
+		item.Metadata["color"] = c.Color
+	}
+
+	if len(item.Metadata) == 0 {
+		item.Metadata = nil
+	}
+
+	return item
+}
+
+func buildZone(server *Server, name string, content []Content) Zone {
+	zone := Zone{Name: name, Items: make([]ZoneItem, 0, len(content))}
+	duration := zoneDuration(server, name)
+
+	for _, c := range content {
+		zone.Items = append(zone.Items, buildZoneItem(c, duration))
+	}
+
+	return zone
+}
+
+func buildContentV2Response(server *Server, res ContentResponse) ContentV2Response {
+	return ContentV2Response{Revision: res.Revision, Zones: []Zone{
+		buildZone(server, ZoneContent, res.ContentImages),
+		buildZone(server, ZoneContent2, res.Content2Images),
+		buildZone(server, ZoneContent3, res.Content3Images),
+		buildZone(server, ZoneMixin, res.MixinImages),
+		buildZone(server, ZoneTicker, res.Ticker),
+		buildZone(server, ZoneTickerDefault, []Content{res.TickerDefault}),
+	}}
+}
+
+func buildConfigV2Response(server *Server) ConfigV2Response {
+	res := ConfigV2Response{ScreenConfig: server.config.ScreenConfig,
+		MixinRate: server.config.MixinImageRate,
+		MaxVideoDuration: server.config.MaxVideoDuration,
+		VideoExtensions: VideoExtensionList,
+		Weather: WeatherConfig{Url: g_config.OpenWeatherMapUrl, ApiKey: g_config.OpenWeatherMapApiKey,
+			CityId: g_config.OpenWeatherMapCityId}}
+
+	for _, zone := range []string{ZoneContent, ZoneContent2, ZoneContent3, ZoneMixin, ZoneTicker, ZoneTickerDefault} {
+		res.Zones = append(res.Zones, ZoneConfig{Name: zone, Duration: zoneDuration(server, zone)})
+	}
+
+	return res
+}
+
+func setJsonHeaders(resp http.ResponseWriter) {
+	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp.Header().Set("Access-Control-Allow-Origin", "*")
+	resp.Header().Set("Cache-Control", jsonCacheControl)
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+func handleGetContentV2Request(server *Server, resp http.ResponseWriter, req *http.Request) {
+	setJsonHeaders(resp)
+
+	var since int64 = -1
+
+	if v := req.URL.Query()["since"]; len(v) > 0 {
+		since, _ = strconv.ParseInt(v[0], 10, 64)
+	}
+
+	ContentMutex.Lock()
+	res := currentContent(server)
+	ContentMutex.Unlock()
+
+	if since > 0 && since == res.Revision {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	d, err := json.Marshal(buildContentV2Response(server, res))
+	if err != nil {
+		Error("handleGetContentV2Request: marshal: %v", err)
+	}
+
+	writeCompressed(resp, req, d)
+}
+
+func handleGetConfigV2Request(server *Server, resp http.ResponseWriter, req *http.Request) {
+	setJsonHeaders(resp)
+
+	d, err := json.Marshal(buildConfigV2Response(server))
+	if err != nil {
+		Error("handleGetConfigV2Request: marshal: %v", err)
+	}
+
+	writeCompressed(resp, req, d)
+}
+
+func handleOpenApiRequest(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	resp.Header().Set("Access-Control-Allow-Origin", "*")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+
+	writeCompressed(resp, req, openApiSpec)
+}
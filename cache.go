@@ -1,125 +1,239 @@
 package main
 
 import (
+	"container/list"
+	"context"
 	"fmt"
-	"sort"
 	"sync"
 	"time"
 )
 
 type ImageCacheEntry struct {
-	timestamp time.Time
+	key string
+	root string
+	name string
 	image []byte
+	hits uint64
 }
 
+// LRU cache of resized images. Entries are kept in a list ordered by their last use, the most recently
+// used entry is located at the front.
 type ImageCache struct {
-	Cache map[string]*ImageCacheEntry
+	Cache map[string]*list.Element
+	Lru *list.List
 	CacheSize int64
 	CacheSizeLimit int64
+	CacheSizeLowWatermark int64
+	Hits uint64
+	Misses uint64
+	Evictions uint64
 	Mutex sync.Mutex
 }
 
+// Image rendition currently being produced, concurrent requests for the same rendition wait for its completion.
+type InflightRendition struct {
+	done chan struct{}
+	image []byte
+	err error
+}
+
 const MB = 1024*1024
 var Cache ImageCache
 
+var inflightRenditions = make(map[string]*InflightRendition)
+var inflightMutex sync.Mutex
+
 
 func InitImageCache() {
-	Cache.Cache = make(map[string]*ImageCacheEntry)
+	if g_config.CacheLowWatermark == 0 || g_config.CacheLowWatermark > 100 {
+		g_config.CacheLowWatermark = 80
+	}
+
+	Cache.Cache = make(map[string]*list.Element)
+	Cache.Lru = list.New()
 	Cache.CacheSize = 0
 	Cache.CacheSizeLimit = int64(g_config.CacheSize*MB)
+	Cache.CacheSizeLowWatermark = Cache.CacheSizeLimit*int64(g_config.CacheLowWatermark)/100
 
 	Info(0, "Cache size: %d MB", g_config.CacheSize)
 }
 
-func BuildCacheKey(name string, width, height uint) string {
-	return fmt.Sprintf("%s/%d/%d", name, width, height)
+// Builds the cache key of an image rendition. Keys are namespaced by the URL root the image is served from.
+func BuildCacheKey(root, name, variant string, width, height uint) string {
+	return fmt.Sprintf("%s%s/%s/%d/%d", root, name, variant, width, height)
+}
+
+func GetImageFromCache(root, name, variant string, width, height uint) []byte {
+	image := lookupImageCache(BuildCacheKey(root, name, variant, width, height))
+
+	Cache.Mutex.Lock()
+	if image != nil {
+		Info(1, "Cache hit for: %s%s %s %d %d", root, name, variant, width,height)
+		Cache.Hits++
+	} else {
+		Cache.Misses++
+	}
+	Cache.Mutex.Unlock()
+
+	return image
 }
 
-func GetImageFromCache(name string, width, height uint) []byte {
+// Looks up a cache entry without updating the hit and miss counters.
+func lookupImageCache(key string) []byte {
 	Cache.Mutex.Lock()
-	ent := Cache.Cache[BuildCacheKey(name, width, height)]
 	defer Cache.Mutex.Unlock()
 
-	if ent != nil {
-		Info(1, "Cache hit for: %s %d %d", name, width,height)
-		ent.timestamp = time.Now()
+	elem := Cache.Cache[key]
+
+	if elem != nil {
+		ent := elem.Value.(*ImageCacheEntry)
+		ent.hits++
+		Cache.Lru.MoveToFront(elem)
 		return ent.image
 	}
 
 	return nil
 }
 
-func addImageToCache(name string, width, height uint, image []byte) {
-
-	Cache.Mutex.Lock()
-
-	key := BuildCacheKey(name, width, height)
+func addImageToCache(root, name, variant string, width, height uint, image []byte) {
+	n := len(image)
 
-	ent := Cache.Cache[key]
+	if int64(n) > Cache.CacheSizeLimit {
+		Info(1, "image '%s%s' %s %d %d exceeds cache size", root, name, variant, width, height)
+		return
+	}
 
-	n:= len(image)
 	imgCopy := make([]byte, n)
 
 	copy(imgCopy, image)
 
-	if ent != nil {
+	Cache.Mutex.Lock()
+	defer Cache.Mutex.Unlock()
+
+	key := BuildCacheKey(root, name, variant, width, height)
+
+	elem := Cache.Cache[key]
+
+	if elem != nil {
+		ent := elem.Value.(*ImageCacheEntry)
 		Cache.CacheSize -= int64(len(ent.image))
+		ent.image = imgCopy
+		Cache.Lru.MoveToFront(elem)
 	} else {
-		ent = new(ImageCacheEntry)
-		Cache.Cache[key] = ent
+		ent := &ImageCacheEntry{key: key, root: root, name: name, image: imgCopy}
+		Cache.Cache[key] = Cache.Lru.PushFront(ent)
 	}
 
-	ent.timestamp = time.Now()
-	ent.image = imgCopy
-
 	Cache.CacheSize += int64(n)
 
-	Info(1, "added image '%s' %d %d to cache, cache size %.3f MB", name, width, height, float32(Cache.CacheSize)/MB)
+	Info(1, "added image '%s%s' %s %d %d to cache, cache size %.3f MB", root, name, variant, width, height, float32(Cache.CacheSize)/MB)
 
 	if Cache.CacheSize > Cache.CacheSizeLimit {
 		cleanCache()
 	}
+}
 
-	Cache.Mutex.Unlock()
+func removeCacheEntry(elem *list.Element) {
+	ent := Cache.Lru.Remove(elem).(*ImageCacheEntry)
+	delete(Cache.Cache, ent.key)
+	Cache.CacheSize -= int64(len(ent.image))
 }
 
+// Removes least recently used entries until the cache size is below the low watermark.
+// Must be called with locked cache mutex.
 func cleanCache() {
-	type SortEntry struct {
-		key string
-		ent *ImageCacheEntry
+	for Cache.CacheSize > Cache.CacheSizeLowWatermark && Cache.Lru.Len() > 0 {
+		elem := Cache.Lru.Back()
+		Info(1, "cleanCache: removing cache entry: %s", elem.Value.(*ImageCacheEntry).key)
+		removeCacheEntry(elem)
+		Cache.Evictions++
 	}
 
-	n := len(Cache.Cache)
-	cacheEntries := make([]SortEntry, n)
+	Info(1, "cleanCache: final cache size %.3f MB", float32(Cache.CacheSize)/MB)
+}
 
-	i := 0
+// Removes all cache entries, or only the entries of a repository file if name is not empty.
+// Returns the number of removed entries.
+func purgeImageCache(name string) int {
+	Cache.Mutex.Lock()
+	defer Cache.Mutex.Unlock()
 
-	for key, ent := range Cache.Cache {
-		cacheEntries[i].key = key
-		cacheEntries[i].ent = ent
-		i++
-	}
+	n := 0
+
+	for elem := Cache.Lru.Front(); elem != nil; {
+		next := elem.Next()
+		ent := elem.Value.(*ImageCacheEntry)
 
-	sort.Slice(cacheEntries, func(a, b int) bool { return cacheEntries[b].ent.timestamp.After(cacheEntries[a].ent.timestamp)})
+		if name == "" || (ent.root == RepUrlRoot && ent.name == name) {
+			removeCacheEntry(elem)
+			n++
+		}
 
-	/*
-	for i = 0; i <n; i++ {
-		Info(0, "Sorted Cache Entry: %s: %s", cacheEntries[i].ent.timestamp.Format(time.RFC3339), cacheEntries[i].key)
+		elem = next
 	}
-*/
 
-	for i = 0; i < n && Cache.CacheSize > Cache.CacheSizeLimit; i++ {
-		Cache.CacheSize -= int64(len(cacheEntries[i].ent.image))
-		if Cache.CacheSize < 0 {
-			Info(1, "cleanCache: cache size < 0")
-			Cache.CacheSize = 0
+	Info(0, "Purged %d entries from image cache", n)
+
+	return n
+}
+
+// Maximum time for decoding, resizing and encoding an image once a worker is available.
+const renditionRenderTimeout = 60 * time.Second
+
+// Produces the image rendition identified by the cache key using the render function. If the same rendition
+// is already being produced by another request, the result of that request is returned instead. Waiting requests
+// give up when their context ends or when the rendition takes longer than waiting for a worker plus rendering.
+// A panic of the render function is returned as error to all waiting requests.
+func coalesceRendition(ctx context.Context, key string, render func() ([]byte, error)) (image []byte, err error) {
+	inflightMutex.Lock()
+
+	call := inflightRenditions[key]
+
+	if call != nil {
+		inflightMutex.Unlock()
+		Info(1, "Waiting for rendition in progress: %s", key)
+
+		var expired <-chan time.Time
+
+		if timeout := imageQueueTimeout(); timeout > 0 {
+			timer := time.NewTimer(timeout + renditionRenderTimeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case <-call.done:
+			return call.image, call.err
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case <-expired:
+			return nil, errImageServiceBusy
 		}
-		Info(1, "cleanCache: removing cache entry: %s", cacheEntries[i].key)
-		delete(Cache.Cache, cacheEntries[i].key)
 	}
 
-	Info(1, "cleanCache: final cache size %.3f MB", float32(Cache.CacheSize)/MB)
-}
+	call = &InflightRendition{done: make(chan struct{})}
+	inflightRenditions[key] = call
 
+	inflightMutex.Unlock()
 
+	defer func() {
+		if r := recover(); r != nil {
+			Error("coalesceRendition: rendition of %s failed: %v", key, r)
+			call.image, call.err = nil, fmt.Errorf("rendition failed: %v", r)
+		}
+
+		inflightMutex.Lock()
+		delete(inflightRenditions, key)
+		inflightMutex.Unlock()
+
+		close(call.done)
 
+		image, err = call.image, call.err
+	}()
+
+	call.image, call.err = render()
+
+	return call.image, call.err
+}
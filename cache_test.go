@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCoalesceRenditionPanic(t *testing.T) {
+	_, err := coalesceRendition(context.Background(), "panic", func() ([]byte, error) {
+		panic("decoder failure")
+	})
+
+	if err == nil {
+		t.Fatal("coalesceRendition: want error for panicking render")
+	}
+
+	// the failed rendition must not block later requests for the same key
+	image, err := coalesceRendition(context.Background(), "panic", func() ([]byte, error) {
+		return []byte("image"), nil
+	})
+
+	if err != nil || string(image) != "image" {
+		t.Fatalf("coalesceRendition after panic = %q, %v", image, err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const EncodingBrotli = "br"
+const EncodingGzip = "gzip"
+
+const brotliLevel = 5
+
+// File extensions of precompressed files served from AppRoot.
+var precompressedExtensions = map[string]string{
+	EncodingBrotli: ".br",
+	EncodingGzip:   ".gz",
+}
+
+// Response writer compressing the body of successful responses.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	head     bool
+	w        io.WriteCloser
+	started  bool
+}
+
+// Returns the supported encodings accepted by the client in order of preference.
+func acceptedEncodings(req *http.Request) []string {
+	accepted := make(map[string]bool)
+
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		enc := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+
+		accepted[enc] = ok
+	}
+
+	var res []string
+
+	for _, enc := range []string{EncodingBrotli, EncodingGzip} {
+		if accepted[enc] {
+			res = append(res, enc)
+		}
+	}
+
+	return res
+}
+
+// Checks whether a content type benefits from compression. Images, videos and fonts are compressed already.
+func isCompressibleType(contentType string) bool {
+	t := strings.TrimSpace(strings.Split(contentType, ";")[0])
+
+	if strings.HasPrefix(t, "text/") {
+		return true
+	}
+
+	switch t {
+	case "application/javascript", "application/json", "application/manifest+json", "application/xml", "image/svg+xml":
+		return true
+	}
+
+	return false
+}
+
+func encodedETag(etag, encoding string) string {
+	if etag == "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""
+}
+
+func newCompressWriter(resp http.ResponseWriter, req *http.Request, encoding string) *compressWriter {
+	return &compressWriter{ResponseWriter: resp, encoding: encoding, head: req.Method == http.MethodHead}
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if !c.started && code == http.StatusOK && c.Header().Get("Content-Encoding") == "" {
+		c.started = true
+
+		c.Header().Set("Content-Encoding", c.encoding)
+		c.Header().Del("Content-Length")
+		c.Header().Del("Accept-Ranges")
+
+		if !c.head {
+			if c.encoding == EncodingBrotli {
+				c.w = brotli.NewWriterLevel(c.ResponseWriter, brotliLevel)
+			} else {
+				c.w = gzip.NewWriter(c.ResponseWriter)
+			}
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.started {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.w != nil {
+		return c.w.Write(b)
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Close() error {
+	if c.w != nil {
+		return c.w.Close()
+	}
+
+	return nil
+}
+
+// Allows http.ResponseController to access the underlying response writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Serves a file, compressed if accepted by the client. For files from AppRoot precompressed
+// siblings (e.g. main.js.br, main.js.gz) are preferred over compressing on the fly.
+func serveFileContent(resp http.ResponseWriter, req *http.Request, urlRoot, basePath, name string, fp *os.File, fi os.FileInfo) {
+	if !g_config.Compression || !isCompressibleType(resp.Header().Get("Content-Type")) || fi.Size() < int64(g_config.CompressionMinSize) {
+		http.ServeContent(resp, req, name, fi.ModTime(), fp)
+		return
+	}
+
+	resp.Header().Add("Vary", "Accept-Encoding")
+
+	encodings := acceptedEncodings(req)
+	etag := resp.Header().Get("ETag")
+
+	if urlRoot != RepUrlRoot {
+		for _, enc := range encodings {
+			cfp, cfi, _, err := openSandboxed(basePath, name+precompressedExtensions[enc])
+
+			if err != nil {
+				continue
+			}
+
+			defer cfp.Close()
+
+			Info(1, "Serving precompressed file: %s%s", name, precompressedExtensions[enc])
+
+			resp.Header().Set("Content-Encoding", enc)
+			resp.Header().Set("ETag", encodedETag(fileETag(urlRoot, name+precompressedExtensions[enc], cfi), enc))
+
+			http.ServeContent(resp, req, name, cfi.ModTime(), cfp)
+			return
+		}
+	}
+
+	// ranges refer to the uncompressed content, so compression on the fly is not possible
+	if len(encodings) > 0 && req.Header.Get("Range") == "" {
+		cw := newCompressWriter(resp, req, encodings[0])
+		defer cw.Close()
+
+		resp.Header().Set("ETag", encodedETag(etag, encodings[0]))
+
+		http.ServeContent(cw, req, name, fi.ModTime(), fp)
+		return
+	}
+
+	http.ServeContent(resp, req, name, fi.ModTime(), fp)
+}
+
+// Writes a generated response body, compressed if accepted by the client.
+func writeCompressed(resp http.ResponseWriter, req *http.Request, data []byte) {
+	if !g_config.Compression || len(data) < g_config.CompressionMinSize {
+		resp.Write(data)
+		return
+	}
+
+	resp.Header().Add("Vary", "Accept-Encoding")
+
+	encodings := acceptedEncodings(req)
+
+	if len(encodings) == 0 {
+		resp.Write(data)
+		return
+	}
+
+	cw := newCompressWriter(resp, req, encodings[0])
+	defer cw.Close()
+
+	cw.Write(data)
+}
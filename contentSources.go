@@ -5,6 +5,7 @@ import (
 	"golang.org/x/text/encoding/charmap"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
 	"unicode/utf8"
 )
@@ -15,6 +16,19 @@ type Content struct {
 	Type string `json:"type"`
 	RepoUrl string `json:"repo_url"`
 	Text string `json:"text"`
+	QrUrl string `json:"qr_url"`
+	PosterUrl string `json:"poster_url,omitempty"`
+	Start string `json:"start,omitempty"`
+	End string `json:"end,omitempty"`
+	Duration uint `json:"duration,omitempty"`
+	Width int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	Size int64 `json:"size,omitempty"`
+	SourceFile string `json:"source_file,omitempty"`
+	SourceModTime string `json:"source_mtime,omitempty"`
+	Hash string `json:"hash,omitempty"`
+	BlurHash string `json:"blurhash,omitempty"`
+	Color string `json:"color,omitempty"`
 }
 
 type ContentSource struct {
@@ -24,12 +38,25 @@ type ContentSource struct {
 	selectFunc func(string) bool
 	content []Content
 	serial int32
+	fit string
+	overlay *OverlayConfig
+	fileInfos map[string]RepoFileInfo
+	pendingFileInfos map[string]RepoFileInfo
+	themeStamp string
+}
+
+// Settings for serving a slide image, derived from the content source and metadata of the slide.
+type RepoFileInfo struct {
+	QrFile string
+	Fit string
+	Overlay *OverlayConfig
 }
 
 
 const ContentTypeImage = "i"
 const ContentTypeVideo = "v"
 const ContentTypeText = "t"
+const ContentTypeHtml = "h"
 
 
 const ContentSourceTypeInfo = ContentSourceType(1)
@@ -39,15 +66,19 @@ const ContentSourceTypeTickerDefault = ContentSourceType(4)
 
 var ContentSources = make(map[string]*ContentSource)
 
+var RepoFileInfos = make(map[string]RepoFileInfo)
+
 var VideoExtensionList = []string{".mp4", ".mov"}
 var ImageExtensionList = []string{".jpg", ".png"}
 var TextExtensionList = []string{".txt"}
+var MarkdownExtensionList = []string{".md"}
 
 
 func setupFileExtensions() {
 	ImageExtensions = make(FileExtMap)
 	TextExtensions = make(FileExtMap)
 	VideoExtensions = make(FileExtMap)
+	MarkdownExtensions = make(FileExtMap)
 
 	for _, e := range ImageExtensionList {
 		ImageExtensions[e] = true
@@ -60,6 +91,10 @@ func setupFileExtensions() {
 	for _, e := range VideoExtensionList {
 		VideoExtensions[e] = true
 	}
+
+	for _, e := range MarkdownExtensionList {
+		MarkdownExtensions[e] = true
+	}
 }
 
 func isImageFile(filename string) bool {
@@ -74,12 +109,22 @@ func isVideoFile(filename string) bool {
 	return VideoExtensions[strings.ToLower(filepath.Ext(filename))]
 }
 
+func isMarkdownFile(filename string) bool {
+	return MarkdownExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
 func isImageOrVideoFile(filename string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
 
 	return ImageExtensions[ext] || VideoExtensions[ext]
 }
 
+func isSlideFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	return ImageExtensions[ext] || VideoExtensions[ext] || MarkdownExtensions[ext] || (TextExtensions[ext] && announcementsEnabled())
+}
+
 
 func getOrCreateContentSource(path string, contentType ContentSourceType) *ContentSource {
 	key := fmt.Sprintf("%s_%d", path, contentType)
@@ -94,10 +139,10 @@ func getOrCreateContentSource(path string, contentType ContentSourceType) *Conte
 
     switch contentType {
 	case ContentSourceTypeInfo:
-		src.selectFunc = isImageOrVideoFile
+		src.selectFunc = isSlideFile
 
 	case ContentSourceTypeDia:
-		src.selectFunc = isImageOrVideoFile
+		src.selectFunc = isSlideFile
 
 	case ContentSourceTypeTicker:
 		src.selectFunc = isTextFile
@@ -112,7 +157,23 @@ func getOrCreateContentSource(path string, contentType ContentSourceType) *Conte
 	return src
 }
 
+// Applies server specific settings for serving images of the content source.
+func configureContentSource(src *ContentSource, fit string, overlay *OverlayConfig) {
+	ContentMutex.Lock()
+	defer ContentMutex.Unlock()
+
+	if fit != "" {
+		src.fit = fit
+	}
+
+	if overlay != nil {
+		src.overlay = overlay
+	}
+}
+
 func updateContentSources() {
+	updateSlideTheme()
+
 	for _, src := range ContentSources {
 		if src.sourcePath != "" {
 			if src.contentType == ContentSourceTypeTickerDefault {
@@ -133,37 +194,59 @@ func updateContentSources() {
 					ContentMutex.Unlock()
 				}
 			} else {
-				nl, h := checkAndImport(src.sourcePath, src.sourceHash, src.selectFunc)
+				refHash := src.sourceHash
 
-				if nl != nil {
-					Info(0, "New content list from source: %s", src.sourcePath)
+				// announcements of slide sources are rendered again with a changed theme
+				if (src.contentType == ContentSourceTypeInfo || src.contentType == ContentSourceTypeDia) && src.themeStamp != slideThemeStamp {
+					refHash = ""
+				}
 
-					ContentMutex.Lock()
+				nl, h := checkAndImport(src.sourcePath, refHash, src.selectFunc)
 
-					src.sourceHash = h
-					src.serial += 1
+				if nl != nil {
+					Info(0, "New content list from source: %s", src.sourcePath)
 
-					src.content = make([]Content, 0, 10)
+					content := make([]Content, 0, 10)
+					infos := make(map[string]RepoFileInfo)
 
-					for _, i := range nl {
-						Info(0, "  %s", i)
+					for _, f := range nl {
+						Info(0, "  %s", f.RepoFile)
 
 						switch src.contentType {
 						case ContentSourceTypeTicker:
-							tent := parserTickerFile(filepath.Join(g_config.RepoRoot, i))
+							tent := parserTickerFile(filepath.Join(g_config.RepoRoot, f.RepoFile))
 							for _, s := range tent {
-								src.content = append(src.content, Content{Type: ContentTypeText, Text: s})
+								c := Content{Type: ContentTypeText, Text: s, QrUrl: qrCodeForText(s)}
+								setSourceMetadata(&c, src, f)
+								content = append(content, c)
 							}
 
 						case ContentSourceTypeInfo, ContentSourceTypeDia:
-							if isVideoFile(i) {
-								src.content = append(src.content, Content{Type: ContentTypeVideo, RepoUrl: i})
-							} else {
-								src.content = append(src.content, Content{Type: ContentTypeImage, RepoUrl: i})
+							if c, ok := importSlideFile(src, f, infos); ok {
+								content = append(content, c)
 							}
 						}
 					}
 
+					// settings of the new images are needed for pre-rendering
+					ContentMutex.Lock()
+					src.pendingFileInfos = infos
+					rebuildRepoFileInfos()
+					ContentMutex.Unlock()
+
+					// pre-render images before clients get to know the new content list
+					warmupRenditions(src, content)
+
+					ContentMutex.Lock()
+
+					src.sourceHash = h
+					src.themeStamp = slideThemeStamp
+					src.serial += 1
+					src.content = content
+					src.fileInfos = infos
+					src.pendingFileInfos = nil
+					rebuildRepoFileInfos()
+
 					ContentMutex.Unlock()
 				}
 			}
@@ -171,15 +254,102 @@ func updateContentSources() {
 	}
 }
 
-func parserTickerFile(path string) []string {
-	buf, err := ioutil.ReadFile(path)
+// Builds the content entry of a slide file, which is either an image, a video, a markdown or an announcement file.
+// Serving settings of the repository files referenced by the content entry are added to infos.
+func importSlideFile(src *ContentSource, f ImportedFile, infos map[string]RepoFileInfo) (Content, bool) {
+	var c Content
 
-	var res []string
+	meta := readSidecarMetadata(f.SourcePath)
 
+	if isVideoFile(f.RepoFile) {
+		c = Content{Type: ContentTypeVideo, RepoUrl: f.RepoFile}
+
+		if poster := findPosterFile(f.SourcePath, meta); poster != "" {
+			c.PosterUrl = copyToRepo(poster)
+		}
+	} else if isMarkdownFile(f.RepoFile) {
+		c = Content{Type: ContentTypeHtml, RepoUrl: importMarkdownFile(f.RepoFile)}
+	} else if isTextFile(f.RepoFile) {
+		c = Content{Type: ContentTypeImage, RepoUrl: importAnnouncementFile(f.RepoFile)}
+	} else {
+		c = Content{Type: ContentTypeImage, RepoUrl: f.RepoFile}
+	}
+
+	if c.RepoUrl == "" {
+		return c, false
+	}
+
+	if meta.Url != "" {
+		c.QrUrl = createQrCode(meta.Url)
+	} else if isMarkdownFile(f.RepoFile) || isTextFile(f.RepoFile) {
+		c.QrUrl = qrCodeForFile(filepath.Join(g_config.RepoRoot, f.RepoFile))
+	}
+
+	setFileMetadata(&c, src, f)
+
+	c.Start = parseScheduleTime(meta.Start, false)
+	c.End = parseScheduleTime(meta.End, true)
+	c.Duration = meta.Duration
+
+	infos[c.RepoUrl] = RepoFileInfo{QrFile: c.QrUrl, Fit: src.fit, Overlay: src.overlay}
+
+	return c, true
+}
+
+// Rebuilds the serving settings of repository files from the content currently published by the content
+// sources, including content about to be published. If a file is published by several sources with different
+// settings, the settings of the first source in alphabetical order of the source paths are used.
+// Must be called with locked content mutex.
+func rebuildRepoFileInfos() {
+	infos := make(map[string]RepoFileInfo)
+	owners := make(map[string]string)
+
+	keys := make([]string, 0, len(ContentSources))
+	for key := range ContentSources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		src := ContentSources[key]
+
+		for _, fi := range []map[string]RepoFileInfo{src.pendingFileInfos, src.fileInfos} {
+			for name, info := range fi {
+				if prev, ok := infos[name]; ok {
+					if owners[name] != key && !sameRepoFileInfo(prev, info) {
+						Error("Conflicting settings for %s in content sources %s and %s, using those of %s",
+							name, owners[name], key, owners[name])
+					}
+					continue
+				}
+
+				infos[name] = info
+				owners[name] = key
+			}
+		}
+	}
+
+	RepoFileInfos = infos
+}
+
+func sameRepoFileInfo(a, b RepoFileInfo) bool {
+	return a.QrFile == b.QrFile && a.Fit == b.Fit && sameOverlayConfig(a.Overlay, b.Overlay)
+}
+
+func getRepoFileInfo(repoFile string) RepoFileInfo {
+	ContentMutex.Lock()
+	defer ContentMutex.Unlock()
+
+	return RepoFileInfos[repoFile]
+}
+
+// Reads a text file. Files with an invalid UTF-8 encoding are converted from Windows code page 1252.
+func readTextFile(path string) (string, bool) {
+	buf, err := ioutil.ReadFile(path)
 
 	if err != nil {
-		Error("Failed to read ticker file: %s: %s", path, err.Error())
-		return nil
+		Error("Failed to read text file: %s: %s", path, err.Error())
+		return "", false
 	}
 
 	sbuf := string(buf)
@@ -194,6 +364,18 @@ func parserTickerFile(path string) []string {
 		}
 	}
 
+	return sbuf, true
+}
+
+func parserTickerFile(path string) []string {
+	var res []string
+
+	sbuf, ok := readTextFile(path)
+
+	if !ok {
+		return nil
+	}
+
 	tickerData := strings.Split(sbuf, "\n")
 
 	state := 0 // states: 0: remove empty lines, 1: collect ticker data
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry of the disk cache. Renditions of a repository file are stored in a sub-directory of the
+// disk cache directory named like the repository file.
+type DiskCacheEntry struct {
+	key  string
+	name string
+	path string
+	size int64
+}
+
+// Persistent second level LRU cache for resized repository images.
+type DiskCache struct {
+	Dir            string
+	Cache          map[string]*list.Element
+	Lru            *list.List
+	CacheSize      int64
+	CacheSizeLimit int64
+	Hits           uint64
+	Misses         uint64
+	Evictions      uint64
+	Mutex          sync.Mutex
+}
+
+const diskCacheDirName = ".cache"
+
+var ImageDiskCache DiskCache
+
+func diskCacheEnabled() bool {
+	return ImageDiskCache.CacheSizeLimit > 0
+}
+
+// Initializes the disk cache from the renditions stored by previous runs.
+func InitDiskCache() {
+	c := &ImageDiskCache
+
+	c.Dir = filepath.Join(g_config.RepoRoot, diskCacheDirName)
+	c.Cache = make(map[string]*list.Element)
+	c.Lru = list.New()
+	c.CacheSize = 0
+	c.CacheSizeLimit = int64(g_config.DiskCacheSize) * MB
+
+	if !diskCacheEnabled() {
+		Info(0, "Disk cache disabled")
+		return
+	}
+
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		Error("InitDiskCache: failed to create directory: %s: %s", c.Dir, err.Error())
+		c.CacheSizeLimit = 0
+		return
+	}
+
+	type fileEntry struct {
+		name    string
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []fileEntry
+
+	dirs, err := ioutil.ReadDir(c.Dir)
+
+	if err != nil {
+		Error("InitDiskCache: failed to read directory: %s: %s", c.Dir, err.Error())
+	}
+
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(filepath.Join(c.Dir, dir.Name()))
+
+		if err != nil {
+			Error("InitDiskCache: failed to read directory: %s: %s", dir.Name(), err.Error())
+			continue
+		}
+
+		for _, e := range entries {
+			if filepath.Ext(e.Name()) == ".tmp" {
+				os.Remove(filepath.Join(c.Dir, dir.Name(), e.Name()))
+				continue
+			}
+			files = append(files, fileEntry{name: dir.Name(), path: filepath.Join(c.Dir, dir.Name(), e.Name()),
+				size: e.Size(), modTime: e.ModTime()})
+		}
+	}
+
+	// oldest files first, so that the most recently used file ends up at the front
+	sort.Slice(files, func(a, b int) bool { return files[a].modTime.Before(files[b].modTime) })
+
+	for _, f := range files {
+		key := filepath.Base(f.path)
+		c.Cache[key] = c.Lru.PushFront(&DiskCacheEntry{key: key, name: f.name, path: f.path, size: f.size})
+		c.CacheSize += f.size
+	}
+
+	Info(0, "Disk cache size: %d MB, %d entries, %.3f MB used", g_config.DiskCacheSize, len(files), float32(c.CacheSize)/MB)
+
+	c.Mutex.Lock()
+	cleanDiskCacheLocked()
+	c.Mutex.Unlock()
+}
+
+func diskCacheFile(cacheKey string) string {
+	return hashData([]byte(cacheKey))
+}
+
+func GetImageFromDiskCache(root, name, variant string, width, height uint) []byte {
+	if !diskCacheEnabled() || root != RepUrlRoot {
+		return nil
+	}
+
+	c := &ImageDiskCache
+	key := diskCacheFile(BuildCacheKey(root, name, variant, width, height))
+
+	c.Mutex.Lock()
+	elem := c.Cache[key]
+	if elem != nil {
+		c.Lru.MoveToFront(elem)
+		c.Hits++
+	} else {
+		c.Misses++
+	}
+	c.Mutex.Unlock()
+
+	if elem == nil {
+		return nil
+	}
+
+	ent := elem.Value.(*DiskCacheEntry)
+
+	data, err := ioutil.ReadFile(ent.path)
+
+	if err != nil {
+		Error("GetImageFromDiskCache: failed to read file: %s: %s", ent.path, err.Error())
+		return nil
+	}
+
+	now := time.Now()
+	os.Chtimes(ent.path, now, now)
+
+	Info(1, "Disk cache hit for: %s%s %s %d %d", root, name, variant, width, height)
+
+	return data
+}
+
+func addImageToDiskCache(root, name, variant string, width, height uint, image []byte) {
+	if !diskCacheEnabled() || root != RepUrlRoot || int64(len(image)) > ImageDiskCache.CacheSizeLimit {
+		return
+	}
+
+	c := &ImageDiskCache
+	key := diskCacheFile(BuildCacheKey(root, name, variant, width, height))
+	dir := filepath.Join(c.Dir, name)
+	path := filepath.Join(dir, key)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		Error("addImageToDiskCache: failed to create directory: %s: %s", dir, err.Error())
+		return
+	}
+
+	tmpPath := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmpPath, image, 0644); err != nil {
+		Error("addImageToDiskCache: failed to write file: %s: %s", tmpPath, err.Error())
+		os.Remove(tmpPath)
+		return
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		Error("addImageToDiskCache: failed to rename file: %s: %s", tmpPath, err.Error())
+		os.Remove(tmpPath)
+		return
+	}
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if elem := c.Cache[key]; elem != nil {
+		c.CacheSize -= elem.Value.(*DiskCacheEntry).size
+		c.Lru.Remove(elem)
+	}
+
+	c.Cache[key] = c.Lru.PushFront(&DiskCacheEntry{key: key, name: name, path: path, size: int64(len(image))})
+	c.CacheSize += int64(len(image))
+
+	Info(1, "added image '%s%s' %s %d %d to disk cache, cache size %.3f MB", root, name, variant, width, height, float32(c.CacheSize)/MB)
+
+	if c.CacheSize > c.CacheSizeLimit {
+		cleanDiskCacheLocked()
+	}
+}
+
+func removeDiskCacheEntry(elem *list.Element) {
+	c := &ImageDiskCache
+
+	ent := c.Lru.Remove(elem).(*DiskCacheEntry)
+	delete(c.Cache, ent.key)
+	c.CacheSize -= ent.size
+
+	if err := os.Remove(ent.path); err != nil && !os.IsNotExist(err) {
+		Error("removeDiskCacheEntry: failed to remove file: %s: %s", ent.path, err.Error())
+	}
+
+	// remove directory of repository file when empty, fails otherwise
+	os.Remove(filepath.Dir(ent.path))
+}
+
+// Removes renditions of repository files, which do not exist anymore, and least recently used
+// entries until the cache size is below the low watermark. Must be called with locked mutex.
+func cleanDiskCacheLocked() {
+	c := &ImageDiskCache
+
+	missing := make(map[string]bool)
+
+	for elem := c.Lru.Front(); elem != nil; {
+		next := elem.Next()
+		ent := elem.Value.(*DiskCacheEntry)
+
+		gone, checked := missing[ent.name]
+		if !checked {
+			_, err := os.Stat(filepath.Join(g_config.RepoRoot, ent.name))
+			gone = os.IsNotExist(err)
+			missing[ent.name] = gone
+		}
+
+		if gone {
+			Info(1, "cleanDiskCache: removing entry of deleted repository file: %s", ent.name)
+			removeDiskCacheEntry(elem)
+		}
+
+		elem = next
+	}
+
+	if c.CacheSize > c.CacheSizeLimit {
+		lowWatermark := c.CacheSizeLimit * int64(g_config.CacheLowWatermark) / 100
+
+		for c.CacheSize > lowWatermark && c.Lru.Len() > 0 {
+			removeDiskCacheEntry(c.Lru.Back())
+			c.Evictions++
+		}
+	}
+
+	Info(1, "cleanDiskCache: final cache size %.3f MB", float32(c.CacheSize)/MB)
+}
+
+// Removes renditions of repository files, which do not exist anymore.
+func cleanDiskCache() {
+	if !diskCacheEnabled() {
+		return
+	}
+
+	ImageDiskCache.Mutex.Lock()
+	defer ImageDiskCache.Mutex.Unlock()
+
+	cleanDiskCacheLocked()
+}
+
+// Removes all disk cache entries, or only the entries of a repository file if name is not empty.
+// Returns the number of removed entries.
+func purgeDiskCache(name string) int {
+	if !diskCacheEnabled() {
+		return 0
+	}
+
+	c := &ImageDiskCache
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	n := 0
+
+	for elem := c.Lru.Front(); elem != nil; {
+		next := elem.Next()
+
+		if name == "" || elem.Value.(*DiskCacheEntry).name == name {
+			removeDiskCacheEntry(elem)
+			n++
+		}
+
+		elem = next
+	}
+
+	Info(0, "Purged %d entries from disk cache", n)
+
+	return n
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Client connected to the event stream of a server. The events channel signals changed content.
+type EventSubscriber struct {
+	server *Server
+	events chan struct{}
+}
+
+type ContentEvent struct {
+	Revision int64 `json:"revision"`
+	Serial int32 `json:"serial"`
+}
+
+type ConfigEvent struct {
+	ConfigId string `json:"config_id"`
+}
+
+type HeartbeatEvent struct {
+	Time int64 `json:"time"`
+}
+
+var errServerShutdown = errors.New("server shutdown")
+
+var eventSubscribers = make(map[*EventSubscriber]bool)
+var eventMutex sync.Mutex
+
+func subscribeEvents(server *Server) *EventSubscriber {
+	sub := &EventSubscriber{server: server, events: make(chan struct{}, 1)}
+
+	eventMutex.Lock()
+	eventSubscribers[sub] = true
+	eventMutex.Unlock()
+
+	return sub
+}
+
+func unsubscribeEvents(sub *EventSubscriber) {
+	eventMutex.Lock()
+	delete(eventSubscribers, sub)
+	eventMutex.Unlock()
+}
+
+// Notifies all event stream clients of the server about changed content.
+func notifyContentChange(server *Server) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+
+	for sub := range eventSubscribers {
+		if sub.server == server {
+			// a pending notification covers this change as well
+			select {
+			case sub.events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func buildContentEvent(server *Server) ContentEvent {
+	ContentMutex.Lock()
+	defer ContentMutex.Unlock()
+
+	res := currentContent(server)
+
+	return ContentEvent{Revision: res.Revision, Serial: res.Serial}
+}
+
+// Identifies the configuration delivered through /api/config. Clients reconnecting to the event stream
+// after a restart of the service detect a changed configuration by a changed id.
+func configId(server *Server) string {
+	d, err := json.Marshal(buildConfigResponse(server))
+
+	if err != nil {
+		Error("configId: marshal: %v", err)
+		return ""
+	}
+
+	return hashData(d)
+}
+
+func eventHeartbeatInterval() time.Duration {
+	if g_config.EventHeartbeatInterval <= 0 {
+		return 15 * time.Second
+	}
+
+	return time.Duration(g_config.EventHeartbeatInterval) * time.Second
+}
+
+func writeEvent(resp http.ResponseWriter, event string, data interface{}) error {
+	d, err := json.Marshal(data)
+
+	if err != nil {
+		Error("writeEvent: marshal: %v", err)
+		return err
+	}
+
+	_, err = fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", event, d)
+
+	if err != nil {
+		return err
+	}
+
+	return http.NewResponseController(resp).Flush()
+}
+
+// Streams Server-Sent Events to the client: a "config" and a "content" event on connect, a "content" event
+// whenever the content of the server changes and "heartbeat" events in regular intervals.
+func handleEventsRequest(server *Server, resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	resp.Header().Set("Access-Control-Allow-Origin", "*")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// the stream is open until the client disconnects
+	extendWriteDeadline(resp, 0)
+
+	sub := subscribeEvents(server)
+	defer unsubscribeEvents(sub)
+
+	Info(1, "Event stream opened: %s", req.RemoteAddr)
+
+	heartbeat := eventHeartbeatInterval()
+
+	_, err := fmt.Fprintf(resp, "retry: %d\n\n", heartbeat.Milliseconds())
+
+	if err == nil {
+		err = writeEvent(resp, "config", ConfigEvent{ConfigId: configId(server)})
+	}
+
+	if err == nil {
+		err = writeEvent(resp, "content", buildContentEvent(server))
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for err == nil {
+		select {
+		case <-req.Context().Done():
+			err = req.Context().Err()
+
+		case <-sub.server.shutdown:
+			err = errServerShutdown
+
+		case <-sub.events:
+			err = writeEvent(resp, "content", buildContentEvent(server))
+
+		case t := <-ticker.C:
+			err = writeEvent(resp, "heartbeat", HeartbeatEvent{Time: t.Unix()})
+		}
+	}
+
+	Info(1, "Event stream closed: %s: %s", req.RemoteAddr, err.Error())
+}
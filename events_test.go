@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStreamShutdown(t *testing.T) {
+	server := &Server{
+		content1:      getOrCreateContentSource("", ContentSourceTypeInfo),
+		content2:      getOrCreateContentSource("", ContentSourceTypeInfo),
+		content3:      getOrCreateContentSource("", ContentSourceTypeInfo),
+		dias:          getOrCreateContentSource("", ContentSourceTypeDia),
+		ticker:        getOrCreateContentSource("", ContentSourceTypeTicker),
+		tickerDefault: getOrCreateContentSource("", ContentSourceTypeTickerDefault),
+		shutdown:      make(chan struct{}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		handleEventsRequest(server, resp, req)
+	})}
+	httpServer.RegisterOnShutdown(func() { close(server.shutdown) })
+
+	go httpServer.Serve(listener)
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// wait for the initial events
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("first line %q, %v", line, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown with open event stream: %v", err)
+	}
+}
@@ -1,8 +1,21 @@
 module github.com/mua69/infoscreenservice
 
-go 1.17
+go 1.20
 
 require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/buckket/go-blurhash v1.1.0
+	github.com/chai2010/webp v1.4.0
+	github.com/microcosm-cc/bluemonday v1.0.27
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
-	golang.org/x/text v0.3.7
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/yuin/goldmark v1.4.13
+	golang.org/x/image v0.18.0
+	golang.org/x/text v0.16.0
+)
+
+require (
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/gorilla/css v1.0.1 // indirect
+	golang.org/x/net v0.26.0 // indirect
 )
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var errImageTooLarge = errors.New("image too large")
+var errImageServiceBusy = errors.New("image service busy")
+
+var imageWorkers chan struct{}
+var imageQueueLength int32
+
+func InitImageWorkers() {
+	if g_config.ImageWorkers <= 0 {
+		g_config.ImageWorkers = runtime.NumCPU()
+	}
+
+	imageWorkers = make(chan struct{}, g_config.ImageWorkers)
+
+	Info(0, "Image workers: %d", g_config.ImageWorkers)
+}
+
+// Returns the time a resize request waits for a free image worker, or 0 for no limit.
+func imageQueueTimeout() time.Duration {
+	if g_config.ImageQueueTimeout <= 0 {
+		return 0
+	}
+
+	return time.Duration(g_config.ImageQueueTimeout) * time.Second
+}
+
+// Waits for a free image worker. Returns errImageServiceBusy if the queue is full or
+// no worker becomes available within the configured timeout.
+func acquireImageWorker() error {
+	if g_config.ImageQueueLength > 0 && int(atomic.LoadInt32(&imageQueueLength)) >= g_config.ImageQueueLength {
+		Error("acquireImageWorker: queue full")
+		return errImageServiceBusy
+	}
+
+	atomic.AddInt32(&imageQueueLength, 1)
+	defer atomic.AddInt32(&imageQueueLength, -1)
+
+	var expired <-chan time.Time
+
+	if timeout := imageQueueTimeout(); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case imageWorkers <- struct{}{}:
+		return nil
+
+	case <-expired:
+		Error("acquireImageWorker: timeout")
+		return errImageServiceBusy
+	}
+}
+
+func releaseImageWorker() {
+	<-imageWorkers
+}
+
+// Checks the size of the resized image and of the scaled intermediate image against the configured pixel limit.
+func checkRenditionSize(srcWidth, srcHeight int, width, height uint, fit string) error {
+	if g_config.MaxImageMegapixels <= 0 || srcWidth <= 0 || srcHeight <= 0 {
+		return nil
+	}
+
+	pixels := 0.0
+
+	if width != 0 && height != 0 && (fit == FitCover || fit == FitFill || fit == FitBlur) {
+		pixels = float64(width) * float64(height)
+	}
+
+	if width == 0 || height == 0 || fit != FitFill {
+		scale := renditionScale(srcWidth, srcHeight, width, height, fit)
+		pixels = math.Max(pixels, float64(srcWidth)*float64(srcHeight)*scale*scale)
+	}
+
+	if pixels > g_config.MaxImageMegapixels*1e6 {
+		Error("checkRenditionSize: rendition too large: %dx%d from %dx%d", width, height, srcWidth, srcHeight)
+		return errImageTooLarge
+	}
+
+	return nil
+}
+
+// Decodes an image after checking its size against the configured pixel limit.
+func decodeImageLimited(fp *os.File) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(fp)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if g_config.MaxImageMegapixels > 0 && float64(cfg.Width)*float64(cfg.Height) > g_config.MaxImageMegapixels*1e6 {
+		Error("decodeImageLimited: image too large: %s: %dx%d", fp.Name(), cfg.Width, cfg.Height)
+		return nil, "", errImageTooLarge
+	}
+
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+
+	return image.Decode(fp)
+}
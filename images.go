@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Resize modes for images served through /api/rep.
+const FitContain = "contain"
+const FitCover = "cover"
+const FitFill = "fill"
+const FitBlur = "blur"
+
+// Output formats of resized images.
+const FormatPng = "png"
+const FormatJpeg = "jpeg"
+const FormatWebp = "webp"
+
+const blurScale = 16
+const blurRadius = 2
+const blurBrightness = 0.6
+
+type ImageOptions struct {
+	Format    string
+	Fit       string
+	FocusX    float64 // focal point for cropping, relative to the image width
+	FocusY    float64 // focal point for cropping, relative to the image height
+	QrFile    string
+	Overlay   *OverlayConfig
+	OverlayId string
+}
+
+var gravityPoints = map[string][2]float64{
+	"center":       {0.5, 0.5},
+	"top":          {0.5, 0},
+	"bottom":       {0.5, 1},
+	"left":         {0, 0.5},
+	"right":        {1, 0.5},
+	"top-left":     {0, 0},
+	"top-right":    {1, 0},
+	"bottom-left":  {0, 1},
+	"bottom-right": {1, 1},
+}
+
+func isValidImageFormat(format string) bool {
+	switch format {
+	case FormatPng, FormatJpeg, FormatWebp:
+		return true
+	}
+
+	return false
+}
+
+func imageFormatContentType(format string) string {
+	switch format {
+	case FormatJpeg:
+		return "image/jpeg"
+
+	case FormatWebp:
+		return "image/webp"
+
+	default:
+		return "image/png"
+	}
+}
+
+// Selects the output format: the URL query "format" has precedence, otherwise WebP is used
+// if accepted by the client, else the format of the source image is kept.
+func negotiateImageFormat(name string, req *http.Request) (string, error) {
+	if v := req.URL.Query().Get("format"); v != "" {
+		if v == "jpg" {
+			v = FormatJpeg
+		}
+		if !isValidImageFormat(v) {
+			return "", errors.New("invalid image format")
+		}
+		// without WebP encoder the format of the source image is kept
+		if v != FormatWebp || webpSupported {
+			return v, nil
+		}
+	} else if webpSupported && strings.Contains(req.Header.Get("Accept"), "image/webp") {
+		return FormatWebp, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return FormatJpeg, nil
+	}
+
+	return FormatPng, nil
+}
+
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case FormatJpeg:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: g_config.JpegQuality})
+
+	case FormatWebp:
+		return encodeWebp(w, img)
+
+	default:
+		encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+		return encoder.Encode(w, img)
+	}
+}
+
+func isValidFitMode(fit string) bool {
+	switch fit {
+	case FitContain, FitCover, FitFill, FitBlur:
+		return true
+	}
+
+	return false
+}
+
+// Parses the gravity of cropped images, which is either a named position (e.g. "top")
+// or a focal point given as "x,y" in percent of the image size.
+func parseGravity(gravity string) (float64, float64, error) {
+	if p, ok := gravityPoints[gravity]; ok {
+		return p[0], p[1], nil
+	}
+
+	xy := strings.Split(gravity, ",")
+
+	if len(xy) == 2 {
+		x, errx := strconv.ParseFloat(xy[0], 64)
+		y, erry := strconv.ParseFloat(xy[1], 64)
+
+		if errx == nil && erry == nil && x >= 0 && x <= 100 && y >= 0 && y <= 100 {
+			return x / 100, y / 100, nil
+		}
+	}
+
+	return 0, 0, errors.New("invalid gravity")
+}
+
+// Determines the image options from the content source settings of the image,
+// the server configuration and the request.
+func parseImageOptions(server *Server, root, name string, req *http.Request) (ImageOptions, error) {
+	var err error
+	var info RepoFileInfo
+
+	query := req.URL.Query()
+
+	if root == RepUrlRoot {
+		info = getRepoFileInfo(name)
+	}
+
+	opts := ImageOptions{Fit: FitContain, FocusX: 0.5, FocusY: 0.5}
+
+	opts.Format, err = negotiateImageFormat(name, req)
+	if err != nil {
+		return opts, err
+	}
+
+	if info.Fit != "" {
+		opts.Fit = info.Fit
+	}
+
+	if v := query.Get("fit"); v != "" {
+		if !isValidFitMode(v) {
+			return opts, errors.New("invalid fit mode")
+		}
+		opts.Fit = v
+	}
+
+	if v := query.Get("gravity"); v != "" {
+		x, y, err := parseGravity(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.FocusX = x
+		opts.FocusY = y
+	}
+
+	if g_config.QrCodeOverlay {
+		opts.QrFile = info.QrFile
+	}
+
+	// overlays are only drawn onto content images of the repository
+	if root == RepUrlRoot {
+		opts.Overlay = server.config.Overlay
+		if info.Overlay != nil {
+			opts.Overlay = info.Overlay
+		}
+
+		if opts.Overlay != nil {
+			opts.OverlayId = overlayId(opts.Overlay)
+		}
+	}
+
+	return opts, nil
+}
+
+// Returns a string identifying the rendition options, used for building cache keys.
+func (o ImageOptions) variant() string {
+	v := o.Format + "/" + o.Fit
+
+	if o.Fit == FitCover {
+		v += fmt.Sprintf("@%.3f,%.3f", o.FocusX, o.FocusY)
+	}
+
+	if o.QrFile != "" {
+		v += "+" + o.QrFile
+	}
+
+	if o.OverlayId != "" {
+		v += "+" + o.OverlayId
+	}
+
+	return v
+}
+
+// Resizes the image according to the options. If width or height is 0, the image is
+// scaled to the given dimension keeping its aspect ratio.
+func resizeImage(img image.Image, width, height uint, opts ImageOptions) image.Image {
+	var simg image.Image
+
+	if width == 0 || height == 0 {
+		simg = resize.Resize(width, height, img, resize.Bicubic)
+	} else {
+		switch opts.Fit {
+		case FitCover:
+			dst := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+			drawCoverFocus(dst, img, opts.FocusX, opts.FocusY, resize.Bicubic)
+			simg = dst
+
+		case FitFill:
+			simg = resize.Resize(width, height, img, resize.Bicubic)
+
+		case FitBlur:
+			simg = resizeBlur(img, width, height)
+
+		default:
+			simg = resizeContain(img, width, height)
+		}
+	}
+
+	if opts.Overlay != nil && opts.OverlayId != "" {
+		simg = applyOverlay(simg, opts.Overlay)
+	}
+
+	if opts.QrFile != "" {
+		simg = overlayQrCode(simg, opts.QrFile)
+	}
+
+	return simg
+}
+
+// Scales the image to fit into width x height while keeping the aspect ratio.
+func resizeContain(img image.Image, width, height uint) image.Image {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+
+	size := float32(width) / float32(w)
+	h1 := float32(h) * size
+
+	if uint(h1) <= height {
+		return resize.Resize(width, 0, img, resize.Bicubic)
+	}
+
+	return resize.Resize(0, height, img, resize.Bicubic)
+}
+
+// Scales the image so that it covers the complete destination and draws it centered.
+func drawCover(dst draw.Image, src image.Image) {
+	drawCoverFocus(dst, src, 0.5, 0.5, resize.Bilinear)
+}
+
+// Scales the image so that it covers the complete destination. The part of the image
+// around the focal point (fx, fy), given relative to the image size, is drawn.
+func drawCoverFocus(dst draw.Image, src image.Image, fx, fy float64, interp resize.InterpolationFunction) {
+	b := dst.Bounds()
+	sw := src.Bounds().Dx()
+	sh := src.Bounds().Dy()
+
+	if sw == 0 || sh == 0 {
+		return
+	}
+
+	var simg image.Image
+	if float64(b.Dx())/float64(sw) > float64(b.Dy())/float64(sh) {
+		simg = resize.Resize(uint(b.Dx()), 0, src, interp)
+	} else {
+		simg = resize.Resize(0, uint(b.Dy()), src, interp)
+	}
+
+	sb := simg.Bounds()
+
+	offset := image.Pt(cropOffset(sb.Dx(), b.Dx(), fx), cropOffset(sb.Dy(), b.Dy(), fy))
+
+	draw.Draw(dst, b, simg, sb.Min.Add(offset), draw.Src)
+}
+
+// Returns the offset of a window of the given size centered at focus, clamped to the available size.
+func cropOffset(size, window int, focus float64) int {
+	offset := int(focus*float64(size)) - window/2
+
+	if offset > size-window {
+		offset = size - window
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	return offset
+}
+
+// Scales the image to fit into width x height and fills the remaining area with
+// a blurred and darkened copy of the image covering the complete area.
+func resizeBlur(img image.Image, width, height uint) image.Image {
+	small := image.NewRGBA(image.Rect(0, 0, int(width)/blurScale+1, int(height)/blurScale+1))
+	drawCover(small, img)
+
+	boxBlur(small, blurRadius)
+	boxBlur(small, blurRadius)
+	darken(small, blurBrightness)
+
+	bg := resize.Resize(width, height, small, resize.Bicubic)
+
+	dst := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	draw.Draw(dst, dst.Bounds(), bg, bg.Bounds().Min, draw.Src)
+
+	fg := resizeContain(img, width, height)
+
+	pos := image.Pt((int(width)-fg.Bounds().Dx())/2, (int(height)-fg.Bounds().Dy())/2)
+	draw.Draw(dst, fg.Bounds().Sub(fg.Bounds().Min).Add(pos), fg, fg.Bounds().Min, draw.Over)
+
+	return dst
+}
+
+// Applies a horizontal and vertical box blur with the given radius.
+func boxBlur(img *image.RGBA, radius int) {
+	b := img.Bounds()
+	tmp := image.NewRGBA(b)
+
+	blur := func(dst, src *image.RGBA, dx, dy int) {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				var r, g, bl, a, n int
+				for i := -radius; i <= radius; i++ {
+					p := image.Pt(x+i*dx, y+i*dy)
+					if !p.In(b) {
+						continue
+					}
+					c := src.RGBAAt(p.X, p.Y)
+					r += int(c.R)
+					g += int(c.G)
+					bl += int(c.B)
+					a += int(c.A)
+					n++
+				}
+				dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: uint8(a / n)})
+			}
+		}
+	}
+
+	blur(tmp, img, 1, 0)
+	blur(img, tmp, 0, 1)
+}
+
+func darken(img *image.RGBA, factor float64) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		img.Pix[i] = uint8(float64(img.Pix[i]) * factor)
+		img.Pix[i+1] = uint8(float64(img.Pix[i+1]) * factor)
+		img.Pix[i+2] = uint8(float64(img.Pix[i+2]) * factor)
+	}
+}
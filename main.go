@@ -5,16 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/nfnt/resize"
-	"image"
 	_ "image/jpeg"
-	"image/png"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,8 +31,50 @@ type Config struct {
 	TerminateMinute     int
 
 	CacheSize uint
+	CacheLowWatermark uint
+	DiskCacheSize uint
 	RepoRoot string
 
+	SlideThemeDir string
+	SlideBackground string
+	SlideTitleFont string
+	SlideBodyFont string
+	SlideTextColor string
+	SlideBackgroundColor string
+
+	QrCodeOverlay bool
+	QrCodeOverlaySize uint
+
+	JpegQuality int
+	WebpQuality int
+
+	RenditionPolicy string
+	RenditionMaxSize uint
+	RenditionSizes []string
+	RenditionBuckets []uint
+	RenditionMaxUpscale float64
+	ResizeRateLimit int
+
+	MaxImageMegapixels float64
+	ImageWorkers int
+	ImageQueueLength int
+	ImageQueueTimeout int
+
+	WarmupProfiles int
+
+	AdminToken string
+
+	MediaWriteTimeout int
+	AppCacheMaxAge int
+	RenditionCacheMaxAge int
+	FollowSymlinks bool
+	MimeTypes map[string]string
+
+	Compression bool
+	CompressionMinSize int
+
+	EventHeartbeatInterval int
+
 	OpenWeatherMapUrl    string
 	OpenWeatherMapApiKey string
 	OpenWeatherMapCityId string
@@ -46,6 +87,7 @@ type ServerConfig struct {
 	BindAdr string
 
 	AppRoot string
+	SpaFallback bool
 
 	ContentSourceDir string
 	Content2SourceDir string
@@ -54,6 +96,17 @@ type ServerConfig struct {
 	TickerSourceDir string
 	TickerDefaultFile string
 
+	ContentFit string
+	Content2Fit string
+	Content3Fit string
+	ImageFit string
+
+	Overlay *OverlayConfig
+	ContentOverlay *OverlayConfig
+	Content2Overlay *OverlayConfig
+	Content3Overlay *OverlayConfig
+	ImageOverlay *OverlayConfig
+
 	ScreenConfig uint
 	ContentImageDisplayDuration uint
 	MixinImageDisplayDuration uint
@@ -64,6 +117,7 @@ type ServerConfig struct {
 
 type ContentResponse struct {
 	Serial int32 `json:"serial"`
+	Revision int64 `json:"revision"`
 	ContentImages []Content `json:"content_images"`
 	Content2Images []Content `json:"content2_images"`
 	Content3Images []Content `json:"content3_images"`
@@ -93,6 +147,7 @@ type FileExtMap map[string]bool
 var ImageExtensions FileExtMap
 var TextExtensions FileExtMap
 var VideoExtensions FileExtMap
+var MarkdownExtensions FileExtMap
 
 type Server struct {
 	index int
@@ -104,8 +159,50 @@ type Server struct {
 	dias *ContentSource
 	ticker *ContentSource
 	tickerDefault *ContentSource
+	revision int64
+	revisions []ContentResponse
+	shutdown chan struct{}
 }
 
+// Time granted to active requests, e.g. video downloads, to finish when the http servers are stopped.
+const shutdownTimeout = 10 * time.Second
+
+const RepUrlRoot = "/api/rep/"
+
+// Cache-Control header value of JSON responses, which must always be fetched from the server.
+const jsonCacheControl = "no-store"
+
+// Content types of common file extensions, independent of the system MIME type table.
+var contentTypes = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".htm": "text/html; charset=utf-8",
+	".css": "text/css; charset=utf-8",
+	".js": "application/javascript",
+	".mjs": "application/javascript",
+	".json": "application/json",
+	".map": "application/json",
+	".webmanifest": "application/manifest+json",
+	".txt": "text/plain; charset=utf-8",
+	".md": "text/markdown; charset=utf-8",
+	".xml": "application/xml",
+	".jpg": "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png": "image/png",
+	".gif": "image/gif",
+	".webp": "image/webp",
+	".svg": "image/svg+xml",
+	".ico": "image/x-icon",
+	".mp4": "video/mp4",
+	".mov": "video/quicktime",
+	".webm": "video/webm",
+	".woff": "font/woff",
+	".woff2": "font/woff2",
+	".ttf": "font/ttf",
+	".otf": "font/otf",
+}
+
+var hashedAppFileRegexp = regexp.MustCompile(`\.[0-9a-f]{16,}\.[a-z0-9]+$`)
+
 var Servers []*Server
 
 var ContentMutex sync.Mutex
@@ -122,7 +219,25 @@ var g_config = Config{LogFile:"infoscreen.log",
 	ContentSyncInterval:60,
 	OpenWeatherMapUrl:"http://api.openweathermap.org/data/2.5",
 	CacheSize:100,
+	DiskCacheSize:500,
 	RepoRoot: "rep",
+	SlideBackground: "background.png",
+	SlideTextColor: "#ffffff",
+	SlideBackgroundColor: "#202020",
+	QrCodeOverlaySize: 20,
+	JpegQuality: 85,
+	WebpQuality: 80,
+	RenditionPolicy: RenditionPolicyClamp,
+	RenditionMaxSize: 3840,
+	MaxImageMegapixels: 50,
+	ImageQueueTimeout: 10,
+	WarmupProfiles: 4,
+	MediaWriteTimeout: 3600,
+	RenditionCacheMaxAge: 3600,
+	FollowSymlinks: true,
+	Compression: true,
+	CompressionMinSize: 1024,
+	EventHeartbeatInterval: 15,
 	TerminateHour:-1 }
 
 
@@ -151,105 +266,286 @@ func removeUrlRoot(url, root string) string {
 	return url
 }
 
-func determineContentType(path string) string {
-	switch filepath.Ext(path) {
-	case ".html":
-		return "text/html"
+// Determines the content type of a file from its extension. Unknown extensions are resolved
+// through the configured MimeTypes, the system MIME type table and finally content sniffing.
+func determineContentType(path string, fp *os.File) string {
+	ext := strings.ToLower(filepath.Ext(path))
 
-	case ".css":
-		return "text/css"
+	if t := g_config.MimeTypes[ext]; t != "" {
+		return t
+	}
 
-	case ".js":
-		return "application/javascript"
+	if t := contentTypes[ext]; t != "" {
+		return t
+	}
 
-	default:
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+
+	return sniffContentType(fp)
+}
+
+func sniffContentType(fp *os.File) string {
+	buf := make([]byte, 512)
+
+	n, err := io.ReadFull(fp, buf)
+
+	if _, serr := fp.Seek(0, io.SeekStart); serr != nil {
+		Error("sniffContentType: failed to seek: %s: %s", fp.Name(), serr.Error())
+	}
+
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
 		return "application/octet-stream"
 	}
+
+	return http.DetectContentType(buf[:n])
 }
 
+// Determines the image options and the size of the rendition for a resize request.
+func prepareRendition(server *Server, root, name string, fp *os.File, width, height uint, req *http.Request) (ImageOptions, uint, uint, error) {
+	opts, err := parseImageOptions(server, root, name, req)
+
+	if err != nil {
+		return opts, 0, 0, err
+	}
+
+	width, height, err = applyRenditionPolicy(fp, width, height, opts)
 
-func sendSizedImage(name string, fp *os.File, width, height uint, resp http.ResponseWriter, req *http.Request) {
-	cacheImage := GetImageFromCache(name, width, height)
+	return opts, width, height, err
+}
 
-	if cacheImage != nil {
-		_, err := io.Copy(resp, bytes.NewReader(cacheImage))
-		if err != nil {
-			Error("sendSizedImage: failed send cached image: %s", err.Error())
-			http.NotFound(resp, req)
-		}
-		return
+// Decodes, resizes and encodes an image and adds the result to the image cache.
+func renderSizedImage(root, name string, fp *os.File, width, height uint, opts ImageOptions) ([]byte, error) {
+	err := acquireImageWorker()
+
+	if err != nil {
+		return nil, err
 	}
 
+	defer releaseImageWorker()
+
 	Info(1, "Sizing Image: %s...", fp.Name())
 
-	img, imageType, err := image.Decode(fp)
+	img, imageType, err := decodeImageLimited(fp)
 
 	if err != nil {
-		Error("sendSizedImage: failed to decode image: %s: %s", fp.Name(), err.Error())
-		http.NotFound(resp, req)
-		return
+		Error("renderSizedImage: failed to decode image: %s: %s", fp.Name(), err.Error())
+		return nil, err
 	}
 
 	Info(1, "image type: %s", imageType)
 
-	w := img.Bounds().Dx()
-	h := img.Bounds().Dy()
+	Info(1, "Imagesize: %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
 
-	Info(1, "Imagesize: %dx%d", w, h)
+	if err = checkRenditionSize(img.Bounds().Dx(), img.Bounds().Dy(), width, height, opts.Fit); err != nil {
+		return nil, err
+	}
 
-	size := float32(width)/float32(w)
-	h1 := float32(h)*size
+	simg := resizeImage(img, width, height, opts)
 
-	var simg image.Image
-	if uint(h1) <= height {
-		simg = resize.Resize(width, 0, img, resize.Bicubic)
-	}  else {
-		simg = resize.Resize(0, height, img, resize.Bicubic)
+	imageBuffer := new(bytes.Buffer)
+
+	err = encodeImage(imageBuffer, simg, opts.Format)
+
+	if err != nil {
+		Error("renderSizedImage: failed to encode image: %s", err.Error())
+		return nil, err
 	}
 
-	encoder := png.Encoder{CompressionLevel:png.BestSpeed}
+	addImageToCache(root, name, opts.variant(), width, height, imageBuffer.Bytes())
+	addImageToDiskCache(root, name, opts.variant(), width, height, imageBuffer.Bytes())
 
-	imageBuffer := new(bytes.Buffer)
+	return imageBuffer.Bytes(), nil
+}
+
+// Returns the image rendition either from the memory cache, the disk cache or by resizing the image.
+// Image resizing is limited per client, an empty client name disables the limit.
+func getSizedImage(ctx context.Context, root, name string, fp *os.File, width, height uint, opts ImageOptions, client string) ([]byte, error) {
+	variant := opts.variant()
+
+	if cacheImage := GetImageFromCache(root, name, variant, width, height); cacheImage != nil {
+		return cacheImage, nil
+	}
+
+	for {
+		leader := false
 
-	err = encoder.Encode(imageBuffer, simg)
+		image, err := coalesceRendition(ctx, BuildCacheKey(root, name, variant, width, height), func() ([]byte, error) {
+			leader = true
+
+			// rendition may have been finished by a concurrent request in the meantime
+			if cacheImage := lookupImageCache(BuildCacheKey(root, name, variant, width, height)); cacheImage != nil {
+				return cacheImage, nil
+			}
+
+			if diskImage := GetImageFromDiskCache(root, name, variant, width, height); diskImage != nil {
+				addImageToCache(root, name, variant, width, height, diskImage)
+				return diskImage, nil
+			}
+
+			if client != "" && !allowResize(client) {
+				return nil, errResizeRateLimit
+			}
+
+			return renderSizedImage(root, name, fp, width, height, opts)
+		})
+
+		// the rate limit of the client which produced the rendition does not apply to waiting clients,
+		// they retry with their own limit
+		if err == errResizeRateLimit && !leader {
+			continue
+		}
+
+		return image, err
+	}
+}
+
+// Returns the entity tag of a file. Repository files are named by their content hash, so the name is sufficient.
+func fileETag(root, name string, fi os.FileInfo) string {
+	if root == RepUrlRoot {
+		return "\"" + name + "\""
+	}
+
+	return fmt.Sprintf("\"%x-%x\"", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// Returns the Cache-Control header value of a file. Repository files are named by their content hash
+// and never change. The same applies to app files with a content hash in their name (e.g. main.3f2a8c9d1e7b6a54.js),
+// other app files are revalidated or cached for AppCacheMaxAge seconds.
+func fileCacheControl(root, name string) string {
+	if root == RepUrlRoot || hashedAppFileRegexp.MatchString(name) {
+		return "public, max-age=31536000, immutable"
+	}
+
+	if g_config.AppCacheMaxAge > 0 {
+		return fmt.Sprintf("public, max-age=%d", g_config.AppCacheMaxAge)
+	}
+
+	return "no-cache"
+}
+
+// Replaces the write timeout of the http server for responses which may take long, e.g. videos.
+// A timeout of 0 removes the write deadline.
+func extendWriteDeadline(resp http.ResponseWriter, timeout time.Duration) {
+	var deadline time.Time
+
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err := http.NewResponseController(resp).SetWriteDeadline(deadline)
 
 	if err != nil {
-		Error("sendSizedImage: failed to encode image: %s", err.Error())
+		Info(1, "extendWriteDeadline: %s", err.Error())
+	}
+}
+
+func sendSizedImage(root, name string, fp *os.File, width, height uint, opts ImageOptions, resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", imageFormatContentType(opts.Format))
+	resp.Header().Add("Vary", "Accept")
+
+	var modTime time.Time
+
+	if fi, err := fp.Stat(); err == nil {
+		modTime = fi.ModTime()
+		resp.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	etag := "\""+hashData([]byte(BuildCacheKey(root, name, opts.variant(), width, height)+modTime.String()))+"\""
+
+	resp.Header().Set("ETag", etag)
+
+	// renditions depend on server settings like overlays, so they are cached for a limited time only
+	if g_config.RenditionCacheMaxAge > 0 {
+		resp.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", g_config.RenditionCacheMaxAge))
+	} else {
+		resp.Header().Set("Cache-Control", "no-cache")
+	}
+
+	// conditional requests are answered before producing the rendition, as the ETag identifies the
+	// rendition parameters including the server settings
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// HEAD requests are only answered with the content length if the rendition is cached
+	if req.Method == http.MethodHead && lookupImageCache(BuildCacheKey(root, name, opts.variant(), width, height)) == nil {
+		resp.WriteHeader(http.StatusOK)
+		return
+	}
+
+	data, err := getSizedImage(req.Context(), root, name, fp, width, height, opts, clientAddress(req))
+
+	switch err {
+	case nil:
+
+	case errResizeRateLimit:
+		resp.Header().Set("Retry-After", "60")
+		http.Error(resp, err.Error(), http.StatusTooManyRequests)
+		return
+
+	case errImageServiceBusy:
+		resp.Header().Set("Retry-After", "10")
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+		return
+
+	case errImageTooLarge:
+		http.Error(resp, err.Error(), http.StatusUnprocessableEntity)
+		return
+
+	default:
 		http.NotFound(resp, req)
 		return
 	}
 
-	addImageToCache(name, width, height, imageBuffer.Bytes())
+	// no modification time, If-Modified-Since does not cover changed server settings
+	http.ServeContent(resp, req, name, time.Time{}, bytes.NewReader(data))
+}
 
-	_, err = io.Copy(resp, imageBuffer)
+// Checks whether the If-None-Match header of a request matches the ETag.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
 
-	if err != nil {
-		Error("sendSizedImage: failed send image: %s", err.Error())
+		if t == "*" || t == etag {
+			return true
+		}
 	}
+
+	return false
 }
 
-func serveFile(urlRoot, basePath string, resp http.ResponseWriter, req *http.Request) {
+func serveFile(server *Server, urlRoot, basePath string, resp http.ResponseWriter, req *http.Request) {
 	path := removeUrlRoot(req.URL.Path, urlRoot)
 
 	if path == "" {
 		path = "index.html"
 	}
 
-	path = filepath.Join(basePath, path)
-
 	Info(1, "Request: %s", req.URL.Path)
 
-	fp, err := os.Open(path)
+	fp, fi, name, err := openSandboxed(basePath, path)
+
+	if err != nil && urlRoot == "/" && server.config.SpaFallback && isAppRoute(path) {
+		Info(1, "Serving index.html for app route: %s", path)
+		path = "index.html"
+		fp, fi, name, err = openSandboxed(basePath, path)
+	}
 
 	if err != nil {
-		Error("app request: failed to open file: %s", path)
+		Error("app request: failed to open file: %s: %s", path, err.Error())
 		http.NotFound(resp, req)
 		return
 	}
 
+	path = filepath.Join(basePath, filepath.FromSlash(name))
+
 	defer fp.Close()
 
-	resp.Header().Set("Content-Type", determineContentType(path))
+	resp.Header().Set("Content-Type", determineContentType(path, fp))
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
 
 	query := req.URL.Query()
 
@@ -262,33 +558,63 @@ func serveFile(urlRoot, basePath string, resp http.ResponseWriter, req *http.Req
 		imgHeight, _ = strconv.Atoi(v[0])
 	}
 
+	if imgWidth < 0 {
+		imgWidth = 0
+	}
+	if imgHeight < 0 {
+		imgHeight = 0
+	}
+
 	Info(1, "Found w, h: %d %d", imgWidth, imgHeight)
 
-	if isImageFile(path) && imgWidth > 0 && imgHeight > 0 {
-		sendSizedImage(filepath.Base(path), fp, uint(imgWidth), uint(imgHeight), resp, req)
-	} else {
-		_, err = io.Copy(resp, fp)
+	if isImageFile(path) && (imgWidth > 0 || imgHeight > 0) {
+		opts, width, height, err := prepareRendition(server, urlRoot, name, fp, uint(imgWidth), uint(imgHeight), req)
 
 		if err != nil {
-			Error("app request: failed to copy file to response: %s", path)
-			http.NotFound(resp, req)
+			http.Error(resp, err.Error(), http.StatusBadRequest)
 			return
 		}
+
+		if urlRoot == RepUrlRoot {
+			recordRenditionRequest(server, req, width, height)
+		}
+
+		sendSizedImage(urlRoot, name, fp, width, height, opts, resp, req)
+	} else {
+		resp.Header().Set("ETag", fileETag(urlRoot, name, fi))
+
+		extendWriteDeadline(resp, time.Duration(g_config.MediaWriteTimeout)*time.Second)
+
+		resp.Header().Set("Cache-Control", fileCacheControl(urlRoot, name))
+
+		serveFileContent(resp, req, urlRoot, basePath, name, fp, fi)
 	}
 }
 
+// Checks whether a path below "/" not matching any file is a route of the single page app. Routes have no
+// file extension in their last segment, paths below /api/ are never routes.
+func isAppRoute(path string) bool {
+	path = strings.Trim(path, "/")
+
+	if path == "api" || strings.HasPrefix(path, "api/") {
+		return false
+	}
+
+	return filepath.Ext(path[strings.LastIndex(path, "/")+1:]) == ""
+}
+
 func handleAppRequest(server *Server, resp http.ResponseWriter, req *http.Request) {
 	//resp.Header().Set("Content-Type", "application/json; charset=utf-8")
 	//resp.Header().Set("Access-Control-Allow-Origin", "*")
 
-	serveFile("/", server.config.AppRoot, resp, req)
+	serveFile(server, "/", server.config.AppRoot, resp, req)
 }
 
-func handleRepRequest(resp http.ResponseWriter, req *http.Request) {
+func handleRepRequest(server *Server, resp http.ResponseWriter, req *http.Request) {
 	//resp.Header().Set("Content-Type", "application/json; charset=utf-8")
 	//resp.Header().Set("Access-Control-Allow-Origin", "*")
 
-	serveFile("/api/rep/", g_config.RepoRoot, resp, req)
+	serveFile(server, RepUrlRoot, g_config.RepoRoot, resp, req)
 }
 
 func buildSerial(content... *ContentSource) int32 {
@@ -302,32 +628,58 @@ func buildSerial(content... *ContentSource) int32 {
 func handleGetContentRequest(server *Server, resp http.ResponseWriter, req *http.Request) {
 	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
 	resp.Header().Set("Access-Control-Allow-Origin", "*")
+	resp.Header().Set("Cache-Control", jsonCacheControl)
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var since int64 = -1
+
+	if v := req.URL.Query()["since"]; len(v) > 0 {
+		since, _ = strconv.ParseInt(v[0], 10, 64)
+	}
 
 	ContentMutex.Lock()
 
-	serial := buildSerial(server.content1, server.content2, server.content3,
-		server.dias, server.ticker, server.tickerDefault)
+	res := currentContent(server)
+
+	if since > 0 && since == res.Revision {
+		ContentMutex.Unlock()
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-	res := ContentResponse{Serial:serial,
-		ContentImages:server.content1.content, Content2Images:server.content2.content,
-		Content3Images:server.content3.content, MixinImages:server.dias.content,
-		Ticker:server.ticker.content, TickerDefault:server.tickerDefault.content[0]}
+	var d []byte
+	var err error
+
+	if prev, ok := previousContent(server, since); ok && since > 0 {
+		d, err = json.Marshal(buildContentDelta(prev, res))
+	} else {
+		d, err = json.Marshal(res)
+	}
 
-	d, err := json.Marshal(res)
 	if err != nil {
 		Error("handleGetImagesRequest: marshal: %v\n", err)
 	}
 
 	ContentMutex.Unlock()
 
-	io.WriteString(resp, string(d))
+	writeCompressed(resp, req, d)
 }
 
 func handleGetConfigRequest(server *Server, resp http.ResponseWriter, req *http.Request) {
 	resp.Header().Set("Content-Type", "application/json; charset=utf-8")
 	resp.Header().Set("Access-Control-Allow-Origin", "*")
+	resp.Header().Set("Cache-Control", jsonCacheControl)
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+
+	d, err := json.Marshal(buildConfigResponse(server))
+	if err != nil {
+		Error("handleGetConfig: marshal: %v\n", err)
+	}
+	writeCompressed(resp, req, d)
+}
 
-	res := ConfigResponse{ScreenConfig:server.config.ScreenConfig,
+func buildConfigResponse(server *Server) ConfigResponse {
+	return ConfigResponse{ScreenConfig:server.config.ScreenConfig,
 		ContentImageDisplayDuration:server.config.ContentImageDisplayDuration,
 		TickerDisplayDuration:server.config.TickerDisplayDuration,
 		MixinImageRate:server.config.MixinImageRate,
@@ -337,12 +689,6 @@ func handleGetConfigRequest(server *Server, resp http.ResponseWriter, req *http.
 		OpenWeatherMapApiKey:g_config.OpenWeatherMapApiKey,
 		OpenWeatherMapCityId:g_config.OpenWeatherMapCityId,
 		VideoExtensions:VideoExtensionList}
-
-	d, err := json.Marshal(res)
-	if err != nil {
-		Error("handleGetConfig: marshal: %v\n", err)
-	}
-	io.WriteString(resp, string(d))
 }
 
 func syncContent() {
@@ -351,6 +697,10 @@ func syncContent() {
 
 		updateContentSources()
 
+		updateContentRevisions()
+
+		cleanDiskCache()
+
 		time.Sleep(time.Duration(g_config.ContentSyncInterval) * time.Second)
 	}
 }
@@ -363,9 +713,12 @@ func terminate() {
 
 		if now.Hour() == g_config.TerminateHour && now.Minute() == g_config.TerminateMinute {
 			for _, server := range Servers {
-				err := server.httpServer.Shutdown(context.Background())
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				err := server.httpServer.Shutdown(ctx)
+				cancel()
 				if err != nil {
 					Error("Error will stopping http server[%d]: %s", server.index, err.Error())
+					server.httpServer.Close()
 				}
 			}
 			stopBrowser()
@@ -417,9 +770,14 @@ func startHttpServer(server *Server) {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request){handleAppRequest(server, resp, req)})
-	mux.HandleFunc("/api/rep/", handleRepRequest)
+	mux.HandleFunc(RepUrlRoot, func(resp http.ResponseWriter, req *http.Request){handleRepRequest(server, resp, req)})
 	mux.HandleFunc("/api/content", func(resp http.ResponseWriter, req *http.Request){handleGetContentRequest(server, resp, req)})
+	mux.HandleFunc("/api/admin/cache", handleAdminCacheRequest)
 	mux.HandleFunc("/api/config", func(resp http.ResponseWriter, req *http.Request){handleGetConfigRequest(server, resp, req)})
+	mux.HandleFunc("/api/events", func(resp http.ResponseWriter, req *http.Request){handleEventsRequest(server, resp, req)})
+	mux.HandleFunc(ApiV2UrlRoot+"content", func(resp http.ResponseWriter, req *http.Request){handleGetContentV2Request(server, resp, req)})
+	mux.HandleFunc(ApiV2UrlRoot+"config", func(resp http.ResponseWriter, req *http.Request){handleGetConfigV2Request(server, resp, req)})
+	mux.HandleFunc(ApiV2UrlRoot+"openapi.json", handleOpenApiRequest)
 
 	server.httpServer = &http.Server{
 		Addr:           fmt.Sprintf("%s:%d", server.config.BindAdr, server.config.BindPort),
@@ -429,6 +787,10 @@ func startHttpServer(server *Server) {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	// long-lived requests like event streams end when the server shuts down
+	server.shutdown = make(chan struct{})
+	server.httpServer.RegisterOnShutdown(func() { close(server.shutdown) })
+
 	Info(0,"http server [%d] exited: %s", server.index, server.httpServer.ListenAndServe())
 }
 
@@ -479,11 +841,70 @@ func checkServerConfig(server *Server) {
 		err = true
 	}
 
+	for _, fit := range []string{c.ContentFit, c.Content2Fit, c.Content3Fit, c.ImageFit} {
+		if fit != "" && !isValidFitMode(fit) {
+			Error("Server[%d]: invalid fit mode: %s", serverIndex, fit)
+			err = true
+		}
+	}
+
+	for _, overlay := range []*OverlayConfig{c.Overlay, c.ContentOverlay, c.Content2Overlay, c.Content3Overlay, c.ImageOverlay} {
+		if overlay != nil && !checkOverlayConfig(overlay) {
+			Error("Server[%d]: invalid overlay configuration.", serverIndex)
+			err = true
+		}
+	}
+
+	if !checkSharedSourceSettings(server) {
+		err = true
+	}
+
 	if err {
 		Fatal("Server[%d]: Error(s) in server configuration", serverIndex)
 	}
 }
 
+// Settings of a slide source directory configured for a server.
+type slideSourceSettings struct {
+	dir string
+	contentType ContentSourceType
+	fit string
+	overlay *OverlayConfig
+}
+
+func slideSources(c *ServerConfig) []slideSourceSettings {
+	return []slideSourceSettings{
+		{c.ContentSourceDir, ContentSourceTypeInfo, c.ContentFit, c.ContentOverlay},
+		{c.Content2SourceDir, ContentSourceTypeInfo, c.Content2Fit, c.Content2Overlay},
+		{c.Content3SourceDir, ContentSourceTypeInfo, c.Content3Fit, c.Content3Overlay},
+		{c.ImageSourceDir, ContentSourceTypeDia, c.ImageFit, c.ImageOverlay},
+	}
+}
+
+// Checks that servers sharing a content source directory configure the same fit mode and overlay for it,
+// as these settings apply to the content source and not to the server.
+func checkSharedSourceSettings(server *Server) bool {
+	ok := true
+
+	for _, a := range slideSources(&server.config) {
+		for i := 0; i <= server.index; i++ {
+			for _, b := range slideSources(&Servers[i].config) {
+				if a.dir == "" || a.dir != b.dir || a.contentType != b.contentType {
+					continue
+				}
+
+				if a.fit != b.fit || !sameOverlayConfig(a.overlay, b.overlay) {
+					Error("Server[%d]: fit mode or overlay of content source %s differs from server %d.",
+						server.index, a.dir, i)
+					ok = false
+				}
+			}
+		}
+	}
+
+	return ok
+}
+
 func setupServers() {
 	if len(g_config.Servers) == 0 {
 		Fatal("No servers configured.")
@@ -502,6 +923,10 @@ func setupServers() {
 		server.content2 = getOrCreateContentSource(server.config.Content2SourceDir, ContentSourceTypeInfo)
 		server.content3 = getOrCreateContentSource(server.config.Content3SourceDir, ContentSourceTypeInfo)
 		server.dias = getOrCreateContentSource(server.config.ImageSourceDir, ContentSourceTypeDia)
+		configureContentSource(server.content1, server.config.ContentFit, server.config.ContentOverlay)
+		configureContentSource(server.content2, server.config.Content2Fit, server.config.Content2Overlay)
+		configureContentSource(server.content3, server.config.Content3Fit, server.config.Content3Overlay)
+		configureContentSource(server.dias, server.config.ImageFit, server.config.ImageOverlay)
 		go startHttpServer(server)
 	}
 }
@@ -521,13 +946,21 @@ func main() {
 
 	InitImageCache()
 
+	InitDiskCache()
+
+	InitRenditionPolicy()
+
+	InitImageWorkers()
+
 	setupFileExtensions()
 
 
 
+	loadContentRevisions()
+
+	setupServers()
 	go syncContent()
 	go terminate()
-	setupServers()
 	go startBrowser()
 
 	for !Terminate {
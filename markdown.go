@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"path/filepath"
+)
+
+var markdownRenderer = goldmark.New(goldmark.WithExtensions(extension.GFM, extension.Typographer))
+
+var htmlPolicy = bluemonday.UGCPolicy()
+
+const htmlSlideHeader = "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n</head>\n<body>\n"
+const htmlSlideFooter = "</body>\n</html>\n"
+
+// Renders a markdown file to sanitized HTML.
+func renderMarkdownFile(path string) []byte {
+	text, ok := readTextFile(path)
+
+	if !ok {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	err := markdownRenderer.Convert([]byte(text), &buf)
+
+	if err != nil {
+		Error("renderMarkdownFile: failed to render markdown: %s: %s", path, err.Error())
+		return nil
+	}
+
+	res := new(bytes.Buffer)
+	res.WriteString(htmlSlideHeader)
+	res.Write(htmlPolicy.SanitizeBytes(buf.Bytes()))
+	res.WriteString(htmlSlideFooter)
+
+	return res.Bytes()
+}
+
+// Renders a markdown file located in the repository and stores the resulting HTML document
+// in the repository. Returns the name of the HTML repository file or an empty string on error.
+func importMarkdownFile(repoFile string) string {
+	html := renderMarkdownFile(filepath.Join(g_config.RepoRoot, repoFile))
+
+	if html == nil {
+		return ""
+	}
+
+	return storeInRepo(html, ".html")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Optional metadata of a content file, supplied as JSON file next to the content file
+// with the additional extension ".json", e.g. "poster.jpg.json".
+type SidecarMetadata struct {
+	Url string `json:"url"`
+	Start string `json:"start"`
+	End string `json:"end"`
+	Duration uint `json:"duration"`
+	Poster string `json:"poster"`
+}
+
+// Suffix of poster images of videos, e.g. "intro.mp4.poster.jpg". Poster images of videos are not published as slides.
+const posterSuffix = ".poster"
+
+func sidecarPath(path string) string {
+	return path + ".json"
+}
+
+// Removes the poster images of the videos contained in the file list: images named like a video
+// with suffix ".poster" and images referenced by the sidecar metadata of a video.
+func removePosterFiles(files []string) []string {
+	posters := make(map[string]bool)
+
+	for _, f := range files {
+		if isVideoFile(f) {
+			for _, ext := range ImageExtensionList {
+				posters[f+posterSuffix+ext] = true
+			}
+
+			if poster := findPosterFile(f, readSidecarMetadata(f)); poster != "" {
+				posters[poster] = true
+			}
+		}
+	}
+
+	res := files[:0]
+
+	for _, f := range files {
+		if !posters[f] {
+			res = append(res, f)
+		}
+	}
+
+	return res
+}
+
+// Returns the poster image of a video: the image given by the sidecar metadata, relative to the directory
+// of the video, or otherwise an image named like the video with suffix ".poster" and an image extension.
+// Poster paths of the sidecar metadata must stay below the directory of the video.
+func findPosterFile(path string, meta SidecarMetadata) string {
+	if meta.Poster != "" {
+		dir := filepath.Dir(path)
+
+		name, err := sanitizeServedPath(filepath.ToSlash(meta.Poster))
+
+		if err != nil || filepath.IsAbs(meta.Poster) {
+			Error("findPosterFile: invalid poster path: %s", meta.Poster)
+			return ""
+		}
+
+		if !g_config.FollowSymlinks {
+			if err = checkNoSymlinks(dir, name); err != nil {
+				Error("findPosterFile: invalid poster path: %s: %s", meta.Poster, err.Error())
+				return ""
+			}
+		}
+
+		poster := filepath.Join(dir, filepath.FromSlash(name))
+
+		if !isImageFile(poster) {
+			Error("findPosterFile: poster is not an image file: %s", poster)
+			return ""
+		}
+
+		return poster
+	}
+
+	for _, ext := range ImageExtensionList {
+		poster := path + posterSuffix + ext
+
+		if fi, err := os.Stat(poster); err == nil && fi.Mode().IsRegular() {
+			return poster
+		}
+	}
+
+	return ""
+}
+
+func readSidecarMetadata(path string) SidecarMetadata {
+	var meta SidecarMetadata
+
+	data, err := ioutil.ReadFile(sidecarPath(path))
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Error("readSidecarMetadata: failed to read file: %s: %s", sidecarPath(path), err.Error())
+		}
+		return meta
+	}
+
+	err = json.Unmarshal(data, &meta)
+
+	if err != nil {
+		Error("readSidecarMetadata: syntax error in %s: %v", sidecarPath(path), err)
+	}
+
+	return meta
+}
+
+// Converts a schedule time of the sidecar metadata, either RFC 3339 time or a date, to RFC 3339.
+// A date refers to the start of the day for the start of a schedule and to the end of the day for its end.
+func parseScheduleTime(value string, end bool) string {
+	if value == "" {
+		return ""
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Format(time.RFC3339)
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+
+	if err != nil {
+		Error("parseScheduleTime: invalid time: %s", value)
+		return ""
+	}
+
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// Records the origin of a content entry: the source file name relative to the source directory, its modification
+// time and its content hash, which is the name of the imported repository file without extension.
+func setSourceMetadata(c *Content, src *ContentSource, f ImportedFile) {
+	if rel, err := filepath.Rel(src.sourcePath, f.SourcePath); err == nil {
+		c.SourceFile = filepath.ToSlash(rel)
+	} else {
+		c.SourceFile = filepath.Base(f.SourcePath)
+	}
+
+	if !f.SourceModTime.IsZero() {
+		c.SourceModTime = f.SourceModTime.Format(time.RFC3339)
+	}
+
+	c.Hash = strings.TrimSuffix(f.RepoFile, filepath.Ext(f.RepoFile))
+}
+
+// Records the source metadata and the byte size of the served repository file of a content entry. For images
+// and the poster images of videos the dimensions, a BlurHash and the dominant color are recorded as well, so that
+// clients can lay out slides and paint a placeholder before loading the images or videos.
+func setFileMetadata(c *Content, src *ContentSource, f ImportedFile) {
+	setSourceMetadata(c, src, f)
+
+	path := filepath.Join(g_config.RepoRoot, c.RepoUrl)
+
+	fp, err := os.Open(path)
+
+	if err != nil {
+		Error("setFileMetadata: failed to open file: %s: %s", path, err.Error())
+		return
+	}
+
+	if fi, err := fp.Stat(); err == nil {
+		c.Size = fi.Size()
+	}
+
+	name := c.RepoUrl
+
+	if c.Type == ContentTypeVideo && c.PosterUrl != "" {
+		fp.Close()
+
+		name = c.PosterUrl
+		path = filepath.Join(g_config.RepoRoot, name)
+
+		fp, err = os.Open(path)
+
+		if err != nil {
+			Error("setFileMetadata: failed to open file: %s: %s", path, err.Error())
+			return
+		}
+	}
+
+	defer fp.Close()
+
+	if c.Type == ContentTypeImage || name != c.RepoUrl {
+		cfg, _, err := image.DecodeConfig(fp)
+
+		if err != nil {
+			Error("setFileMetadata: failed to decode image: %s: %s", path, err.Error())
+			return
+		}
+
+		c.Width = cfg.Width
+		c.Height = cfg.Height
+
+		p, err := getImagePlaceholder(name, fp)
+
+		if err != nil {
+			Error("setFileMetadata: failed to compute placeholder: %s: %s", path, err.Error())
+			return
+		}
+
+		c.BlurHash = p.BlurHash
+		c.Color = p.Color
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/draw"
+	"os"
+	"sync"
+	"time"
+)
+
+// Overlay positions.
+const OverlayTopLeft = "top-left"
+const OverlayTopRight = "top-right"
+const OverlayBottomLeft = "bottom-left"
+const OverlayBottomRight = "bottom-right"
+const OverlayCenter = "center"
+
+// Configuration of a logo or watermark, which is drawn onto resized images.
+type OverlayConfig struct {
+	File     string // PNG image, may contain an alpha channel
+	Position string // one of top-left, top-right, bottom-left, bottom-right, center
+	Margin   uint   // margin in percent of the smaller image dimension
+	Scale    uint   // width of the overlay in percent of the image width
+}
+
+type overlayImage struct {
+	modTime time.Time
+	size    int64
+	img     image.Image
+}
+
+var overlayImages = make(map[string]*overlayImage)
+var overlayMutex sync.Mutex
+
+func isValidOverlayPosition(pos string) bool {
+	switch pos {
+	case OverlayTopLeft, OverlayTopRight, OverlayBottomLeft, OverlayBottomRight, OverlayCenter:
+		return true
+	}
+
+	return false
+}
+
+func checkOverlayConfig(c *OverlayConfig) bool {
+	if c.Position == "" {
+		c.Position = OverlayTopRight
+	}
+
+	if c.Scale == 0 {
+		c.Scale = 15
+	}
+
+	if c.File == "" {
+		Error("Overlay: file not set.")
+		return false
+	}
+
+	if !isValidOverlayPosition(c.Position) {
+		Error("Overlay: invalid position: %s", c.Position)
+		return false
+	}
+
+	return true
+}
+
+// Returns the overlay image, which is reloaded when the file has changed.
+func loadOverlayImage(path string) (*overlayImage, error) {
+	fi, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	overlayMutex.Lock()
+	defer overlayMutex.Unlock()
+
+	ov := overlayImages[path]
+
+	if ov != nil && ov.modTime.Equal(fi.ModTime()) && ov.size == fi.Size() {
+		return ov, nil
+	}
+
+	fp, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fp.Close()
+
+	img, _, err := image.Decode(fp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	Info(0, "Loaded overlay image: %s", path)
+
+	ov = &overlayImage{modTime: fi.ModTime(), size: fi.Size(), img: img}
+	overlayImages[path] = ov
+
+	return ov, nil
+}
+
+// Returns a string identifying the overlay configuration and the state of the overlay image file.
+// Returns an empty string if the overlay image is not available.
+func overlayId(c *OverlayConfig) string {
+	ov, err := loadOverlayImage(c.File)
+
+	if err != nil {
+		Error("overlayId: failed to load overlay image: %s: %s", c.File, err.Error())
+		return ""
+	}
+
+	id := fmt.Sprintf("%s:%d:%d:%s:%d:%d", c.File, ov.modTime.UnixNano(), ov.size, c.Position, c.Margin, c.Scale)
+
+	return hashData([]byte(id))[:16]
+}
+
+func sameOverlayConfig(a, b *OverlayConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// Draws the overlay onto the image.
+func applyOverlay(img image.Image, c *OverlayConfig) image.Image {
+	ov, err := loadOverlayImage(c.File)
+
+	if err != nil {
+		Error("applyOverlay: failed to load overlay image: %s: %s", c.File, err.Error())
+		return img
+	}
+
+	b := img.Bounds()
+
+	width := b.Dx() * int(c.Scale) / 100
+
+	if width <= 0 {
+		return img
+	}
+
+	simg := resize.Resize(uint(width), 0, ov.img, resize.Bicubic)
+	sb := simg.Bounds()
+
+	margin := b.Dx()
+	if b.Dy() < margin {
+		margin = b.Dy()
+	}
+	margin = margin * int(c.Margin) / 100
+
+	var pos image.Point
+
+	switch c.Position {
+	case OverlayTopLeft:
+		pos = image.Pt(b.Min.X+margin, b.Min.Y+margin)
+	case OverlayTopRight:
+		pos = image.Pt(b.Max.X-margin-sb.Dx(), b.Min.Y+margin)
+	case OverlayBottomLeft:
+		pos = image.Pt(b.Min.X+margin, b.Max.Y-margin-sb.Dy())
+	case OverlayBottomRight:
+		pos = image.Pt(b.Max.X-margin-sb.Dx(), b.Max.Y-margin-sb.Dy())
+	default:
+		pos = image.Pt(b.Min.X+(b.Dx()-sb.Dx())/2, b.Min.Y+(b.Dy()-sb.Dy())/2)
+	}
+
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+	draw.Draw(dst, sb.Sub(sb.Min).Add(pos), simg, sb.Min, draw.Over)
+
+	return dst
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/buckket/go-blurhash"
+	"github.com/nfnt/resize"
+	"image"
+	"io"
+	"os"
+	"sync"
+)
+
+// Placeholder of an image painted by the client until the image is loaded.
+type ImagePlaceholder struct {
+	BlurHash string
+	Color string
+}
+
+// Size of the thumbnail the placeholder is computed from.
+const placeholderThumbnailSize = 64
+
+// Placeholders of repository images. As repository files are named by their content hash,
+// a placeholder never changes once computed.
+var imagePlaceholders = make(map[string]ImagePlaceholder)
+var placeholderMutex sync.Mutex
+
+// Returns the BlurHash and dominant color of a repository image.
+func getImagePlaceholder(name string, fp *os.File) (ImagePlaceholder, error) {
+	placeholderMutex.Lock()
+	p, ok := imagePlaceholders[name]
+	placeholderMutex.Unlock()
+
+	if ok {
+		return p, nil
+	}
+
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return p, err
+	}
+
+	img, _, err := decodeImageLimited(fp)
+
+	if err != nil {
+		return p, err
+	}
+
+	thumb := resize.Thumbnail(placeholderThumbnailSize, placeholderThumbnailSize, img, resize.Bilinear)
+
+	p.Color = dominantColor(thumb)
+
+	// number of components follows the aspect ratio of the image
+	bounds := thumb.Bounds()
+	xc, yc := 4, 3
+
+	if bounds.Dx() < bounds.Dy() {
+		xc, yc = 3, 4
+	}
+
+	p.BlurHash, err = blurhash.Encode(xc, yc, thumb)
+
+	if err != nil {
+		return p, err
+	}
+
+	placeholderMutex.Lock()
+	imagePlaceholders[name] = p
+	placeholderMutex.Unlock()
+
+	return p, nil
+}
+
+// Determines the most frequent color of an image. Colors are quantized to 4 bits per channel,
+// the result is the average color of the most frequent bucket in "#rrggbb" notation.
+func dominantColor(img image.Image) string {
+	type bucket struct {
+		n, r, g, b uint64
+	}
+
+	var buckets [4096]bucket
+	best := 0
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+
+			if a < 0x8000 {
+				continue
+			}
+
+			i := int(r>>12)<<8 | int(g>>12)<<4 | int(b>>12)
+
+			buckets[i].n++
+			buckets[i].r += uint64(r >> 8)
+			buckets[i].g += uint64(g >> 8)
+			buckets[i].b += uint64(b >> 8)
+
+			if buckets[i].n > buckets[best].n {
+				best = i
+			}
+		}
+	}
+
+	c := buckets[best]
+
+	if c.n == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", c.r/c.n, c.g/c.n, c.b/c.n)
+}
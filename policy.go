@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Handling of requested image sizes, which violate the rendition policy.
+const RenditionPolicyClamp = "clamp"
+const RenditionPolicyReject = "reject"
+
+type RenditionSize struct {
+	Width  uint
+	Height uint
+}
+
+type rateLimitEntry struct {
+	tokens float64
+	last   time.Time
+}
+
+var renditionSizes []RenditionSize
+
+var rateLimits = make(map[string]*rateLimitEntry)
+var rateLimitMutex sync.Mutex
+
+var errRenditionPolicy = errors.New("image size not allowed")
+var errResizeRateLimit = errors.New("too many resize requests")
+
+func InitRenditionPolicy() {
+	switch g_config.RenditionPolicy {
+	case RenditionPolicyClamp, RenditionPolicyReject:
+	default:
+		Fatal("Invalid RenditionPolicy: %s", g_config.RenditionPolicy)
+	}
+
+	renditionSizes = make([]RenditionSize, 0, len(g_config.RenditionSizes))
+
+	for _, s := range g_config.RenditionSizes {
+		var size RenditionSize
+		if _, err := fmt.Sscanf(s, "%dx%d", &size.Width, &size.Height); err != nil {
+			Fatal("Invalid rendition size: %s", s)
+		}
+		renditionSizes = append(renditionSizes, size)
+	}
+
+	if len(renditionSizes) > 0 && len(g_config.RenditionBuckets) > 0 {
+		Fatal("RenditionSizes and RenditionBuckets are mutually exclusive.")
+	}
+}
+
+func absDiff(a, b uint) uint {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Returns the smallest bucket not smaller than v, or the largest bucket.
+func snapToBucket(v uint) (uint, bool) {
+	if v == 0 {
+		return 0, true
+	}
+
+	var largest uint
+	best := uint(math.MaxUint32)
+
+	for _, b := range g_config.RenditionBuckets {
+		if b >= v && b < best {
+			best = b
+		}
+		if b > largest {
+			largest = b
+		}
+	}
+
+	if best == math.MaxUint32 {
+		return largest, false
+	}
+
+	return best, true
+}
+
+// Returns the whitelisted size closest to the requested size.
+func nearestRenditionSize(width, height uint) (RenditionSize, bool) {
+	best := renditionSizes[0]
+
+	for _, s := range renditionSizes {
+		if s.Width == width && s.Height == height {
+			return s, true
+		}
+		if absDiff(s.Width, width)+absDiff(s.Height, height) < absDiff(best.Width, width)+absDiff(best.Height, height) {
+			best = s
+		}
+	}
+
+	return best, false
+}
+
+// Returns the factor by which the source image is scaled for the requested size.
+func renditionScale(srcWidth, srcHeight int, width, height uint, fit string) float64 {
+	sx := float64(width) / float64(srcWidth)
+	sy := float64(height) / float64(srcHeight)
+
+	if width == 0 {
+		return sy
+	}
+
+	if height == 0 {
+		return sx
+	}
+
+	if fit == FitCover || fit == FitFill {
+		return math.Max(sx, sy)
+	}
+
+	return math.Min(sx, sy)
+}
+
+// Applies the rendition policy to the requested image size. Depending on the configured policy, sizes violating
+// the policy are either clamped to an allowed size or rejected with an error.
+func applyRenditionPolicy(fp *os.File, width, height uint, opts ImageOptions) (uint, uint, error) {
+	reject := g_config.RenditionPolicy == RenditionPolicyReject
+	ok := true
+
+	if max := g_config.RenditionMaxSize; max > 0 {
+		if width > max {
+			width = max
+			ok = false
+		}
+		if height > max {
+			height = max
+			ok = false
+		}
+	}
+
+	if len(renditionSizes) > 0 {
+		var size RenditionSize
+		var exact bool
+
+		size, exact = nearestRenditionSize(width, height)
+		ok = ok && exact
+		width = size.Width
+		height = size.Height
+	} else if len(g_config.RenditionBuckets) > 0 {
+		var okw, okh bool
+
+		width, okw = snapToBucket(width)
+		height, okh = snapToBucket(height)
+		ok = ok && okw && okh
+	}
+
+	if !ok && reject {
+		return 0, 0, errRenditionPolicy
+	}
+
+	if g_config.RenditionMaxUpscale > 0 {
+		cfg, _, err := image.DecodeConfig(fp)
+
+		if _, serr := fp.Seek(0, io.SeekStart); serr != nil {
+			return 0, 0, serr
+		}
+
+		if err == nil && cfg.Width > 0 && cfg.Height > 0 {
+			scale := renditionScale(cfg.Width, cfg.Height, width, height, opts.Fit)
+
+			if scale > g_config.RenditionMaxUpscale {
+				if reject {
+					return 0, 0, errRenditionPolicy
+				}
+
+				k := g_config.RenditionMaxUpscale / scale
+				width = uint(math.Round(float64(width) * k))
+				height = uint(math.Round(float64(height) * k))
+			}
+		}
+	}
+
+	if width == 0 && height == 0 {
+		return 0, 0, errRenditionPolicy
+	}
+
+	return width, height, nil
+}
+
+func clientAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// Checks whether the client may request another uncached image resize (token bucket per client address).
+func allowResize(client string) bool {
+	limit := float64(g_config.ResizeRateLimit)
+
+	if limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	if len(rateLimits) > 1024 {
+		// entries idle for more than a minute are completely refilled anyway
+		for k, e := range rateLimits {
+			if now.Sub(e.last) > time.Minute {
+				delete(rateLimits, k)
+			}
+		}
+	}
+
+	ent := rateLimits[client]
+
+	if ent == nil {
+		ent = &rateLimitEntry{tokens: limit, last: now}
+		rateLimits[client] = ent
+	}
+
+	ent.tokens = math.Min(limit, ent.tokens+now.Sub(ent.last).Minutes()*limit)
+	ent.last = now
+
+	if ent.tokens < 1 {
+		Info(0, "Resize rate limit exceeded for client: %s", client)
+		return false
+	}
+
+	ent.tokens -= 1
+
+	return true
+}
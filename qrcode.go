@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const qrCodeSize = 512
+const qrCodeMargin = 16
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"'\[\]()]+`)
+
+// Returns the first URL found in the text.
+func findUrl(text string) string {
+	return strings.TrimRight(urlRegexp.FindString(text), ".,;:!?")
+}
+
+// Creates a QR code PNG image for the URL and stores it in the repository.
+// Returns the name of the repository file or an empty string on error.
+func createQrCode(url string) string {
+	data, err := qrcode.Encode(url, qrcode.Medium, qrCodeSize)
+
+	if err != nil {
+		Error("createQrCode: failed to encode url: %s: %s", url, err.Error())
+		return ""
+	}
+
+	return storeInRepo(data, ".png")
+}
+
+func qrCodeForText(text string) string {
+	url := findUrl(text)
+
+	if url == "" {
+		return ""
+	}
+
+	return createQrCode(url)
+}
+
+func qrCodeForFile(path string) string {
+	text, ok := readTextFile(path)
+
+	if !ok {
+		return ""
+	}
+
+	return qrCodeForText(text)
+}
+
+// Draws the QR code into the bottom right corner of the image.
+func overlayQrCode(img image.Image, qrFile string) image.Image {
+	fp, err := os.Open(filepath.Join(g_config.RepoRoot, qrFile))
+
+	if err != nil {
+		Error("overlayQrCode: failed to open QR code: %s", qrFile)
+		return img
+	}
+
+	defer fp.Close()
+
+	qr, _, err := image.Decode(fp)
+
+	if err != nil {
+		Error("overlayQrCode: failed to decode QR code: %s: %s", qrFile, err.Error())
+		return img
+	}
+
+	b := img.Bounds()
+
+	size := b.Dx()
+	if b.Dy() < size {
+		size = b.Dy()
+	}
+	size = size * int(g_config.QrCodeOverlaySize) / 100
+
+	if size <= 0 {
+		return img
+	}
+
+	sqr := resize.Resize(uint(size), uint(size), qr, resize.NearestNeighbor)
+
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+
+	pos := image.Pt(b.Max.X-size-qrCodeMargin, b.Max.Y-size-qrCodeMargin)
+	draw.Draw(dst, image.Rectangle{Min: pos, Max: pos.Add(image.Pt(size, size))}, sqr, sqr.Bounds().Min, draw.Src)
+
+	return dst
+}
@@ -16,6 +16,17 @@ import (
 	"time"
 )
 
+func newRepoHash() hash.Hash {
+	return hmac.New(sha256.New, []byte("infoscreen"))
+}
+
+func hashData(data []byte) string {
+	mac := newRepoHash()
+	mac.Write(data)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 func hashFile(path string) string {
 	fp, err := os.Open(path)
 
@@ -38,7 +49,7 @@ func hashFile(path string) string {
 		return ""
 	}
 
-	mac := hmac.New(sha256.New, []byte("infoscreen"))
+	mac := newRepoHash()
 
 	_, err = io.Copy(mac, fp)
 
@@ -118,6 +129,35 @@ func copyToRepo(path string) string {
 	return repoFile
 }
 
+// Stores generated data in the repository. Returns the name of the repository file or an empty string on error.
+func storeInRepo(data []byte, ext string) string {
+	repoFile := hashData(data) + ext
+
+	repoPath := filepath.Join(g_config.RepoRoot, repoFile)
+
+	fi, err := os.Stat(repoPath)
+
+	if err == nil {
+		if fi.IsDir() {
+			Error("storeInRepo: target is a directory: %s", repoPath)
+			return ""
+		}
+
+		return repoFile
+	}
+
+	Info(0, "Storing in repo: %s", repoPath)
+
+	err = ioutil.WriteFile(repoPath, data, 0644)
+
+	if err != nil {
+		Error("storeInRepo: failed to write file: %s: %s", repoPath, err.Error())
+		return ""
+	}
+
+	return repoFile
+}
+
 func collectFilesFromDirectory(path string, filecheck func(string) bool, mac *hash.Hash) []string {
 	var res []string
 
@@ -140,6 +180,21 @@ func collectFilesFromDirectory(path string, filecheck func(string) bool, mac *ha
 				res = append(res, filepath.Join(path, file.Name()))
 				stamp := fmt.Sprintf("%s-%s-%d", file.Name(), file.ModTime().Format(time.RFC3339), file.Size())
 				io.Copy(*mac, strings.NewReader(stamp))
+
+				if fi, err := os.Stat(sidecarPath(filepath.Join(path, file.Name()))); err == nil {
+					stamp = fmt.Sprintf("%s-%s-%d", fi.Name(), fi.ModTime().Format(time.RFC3339), fi.Size())
+					io.Copy(*mac, strings.NewReader(stamp))
+				}
+
+				if isVideoFile(file.Name()) {
+					videoPath := filepath.Join(path, file.Name())
+					poster := findPosterFile(videoPath, readSidecarMetadata(videoPath))
+
+					if fi, err := os.Stat(poster); poster != "" && err == nil {
+						stamp = fmt.Sprintf("%s-%s-%d", poster, fi.ModTime().Format(time.RFC3339), fi.Size())
+						io.Copy(*mac, strings.NewReader(stamp))
+					}
+				}
 			}
 		}
 	}
@@ -147,10 +202,16 @@ func collectFilesFromDirectory(path string, filecheck func(string) bool, mac *ha
 	return res
 }
 
-func checkAndImport(sourceDir string, refHash string, filecheck func(string) bool) ([]string, string) {
+type ImportedFile struct {
+	RepoFile   string
+	SourcePath string
+	SourceModTime time.Time
+}
+
+func checkAndImport(sourceDir string, refHash string, filecheck func(string) bool) ([]ImportedFile, string) {
 	mac := hmac.New(sha256.New, nil)
 
-	files := collectFilesFromDirectory(sourceDir, filecheck, &mac)
+	files := removePosterFiles(collectFilesFromDirectory(sourceDir, filecheck, &mac))
 
 	sum := mac.Sum(nil)
 
@@ -159,13 +220,19 @@ func checkAndImport(sourceDir string, refHash string, filecheck func(string) boo
 	Info(1, "checkAndImport:hash: %s", h)
 
 	if h != refHash {
-		res := make([]string, 0, 10)
+		res := make([]ImportedFile, 0, 10)
 
 		for _, f := range files {
 			fh := copyToRepo(f)
 
 			if fh != "" {
-				res = append(res, fh)
+				imp := ImportedFile{RepoFile: fh, SourcePath: f}
+
+				if fi, err := os.Stat(f); err == nil {
+					imp.SourceModTime = fi.ModTime()
+				}
+
+				res = append(res, imp)
 			}
 		}
 
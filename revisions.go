@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Persisted content revision of a server. The hash identifies the content the revision refers to,
+// so that unchanged content keeps its revision across restarts.
+type ContentRevision struct {
+	Revision int64
+	Hash string
+}
+
+type ContentListDelta struct {
+	Added []ContentDeltaItem `json:"added"`
+	Removed []int `json:"removed"`
+	Moved []ContentDeltaMove `json:"moved"`
+}
+
+type ContentDeltaItem struct {
+	Index int `json:"index"`
+	Content Content `json:"content"`
+}
+
+type ContentDeltaMove struct {
+	From int `json:"from"`
+	To int `json:"to"`
+}
+
+type ContentDeltaResponse struct {
+	Revision int64 `json:"revision"`
+	Since int64 `json:"since"`
+	Serial int32 `json:"serial"`
+	ContentImages ContentListDelta `json:"content_images"`
+	Content2Images ContentListDelta `json:"content2_images"`
+	Content3Images ContentListDelta `json:"content3_images"`
+	MixinImages ContentListDelta `json:"mixin_images"`
+	Ticker ContentListDelta `json:"ticker"`
+	TickerDefault Content `json:"ticker_default"`
+}
+
+const revisionsFileName = ".revisions.json"
+
+// Number of previous content revisions kept per server for building deltas.
+const contentRevisionHistory = 16
+
+var contentRevisions = make(map[string]ContentRevision)
+
+func revisionsFile() string {
+	return filepath.Join(g_config.RepoRoot, revisionsFileName)
+}
+
+func serverKey(server *Server) string {
+	return fmt.Sprintf("%s:%d", server.config.BindAdr, server.config.BindPort)
+}
+
+func loadContentRevisions() {
+	data, err := ioutil.ReadFile(revisionsFile())
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Error("loadContentRevisions: %s", err.Error())
+		}
+		return
+	}
+
+	if err = json.Unmarshal(data, &contentRevisions); err != nil {
+		Error("loadContentRevisions: %s: %s", revisionsFile(), err.Error())
+	}
+}
+
+func saveContentRevisions() {
+	data, err := json.Marshal(contentRevisions)
+
+	if err != nil {
+		Error("saveContentRevisions: marshal: %v", err)
+		return
+	}
+
+	path := revisionsFile()
+	tmpPath := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		Error("saveContentRevisions: failed to write file: %s: %s", tmpPath, err.Error())
+		os.Remove(tmpPath)
+		return
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		Error("saveContentRevisions: failed to rename file: %s: %s", tmpPath, err.Error())
+		os.Remove(tmpPath)
+	}
+}
+
+// Builds the content response from the current content lists of the server.
+// Must be called with locked content mutex.
+func buildContentResponse(server *Server) ContentResponse {
+	serial := buildSerial(server.content1, server.content2, server.content3,
+		server.dias, server.ticker, server.tickerDefault)
+
+	return ContentResponse{Serial:serial,
+		ContentImages:server.content1.content, Content2Images:server.content2.content,
+		Content3Images:server.content3.content, MixinImages:server.dias.content,
+		Ticker:server.ticker.content, TickerDefault:server.tickerDefault.content[0]}
+}
+
+func contentHash(res ContentResponse) string {
+	res.Serial = 0
+	res.Revision = 0
+
+	d, err := json.Marshal(res)
+
+	if err != nil {
+		Error("contentHash: marshal: %v", err)
+		return ""
+	}
+
+	return hashData(d)
+}
+
+// Assigns a new revision to the content of each server whose content lists changed since the last call
+// and notifies event stream clients of these servers. Called after each content sync.
+func updateContentRevisions() {
+	changed := false
+
+	for _, server := range Servers {
+		ContentMutex.Lock()
+
+		res := buildContentResponse(server)
+		hash := contentHash(res)
+		key := serverKey(server)
+		rev := contentRevisions[key]
+
+		if hash != rev.Hash {
+			rev.Revision++
+			rev.Hash = hash
+			contentRevisions[key] = rev
+			changed = true
+
+			Info(0, "Server[%d]: new content revision %d", server.index, rev.Revision)
+		}
+
+		if rev.Revision == server.revision {
+			ContentMutex.Unlock()
+			continue
+		}
+
+		res.Revision = rev.Revision
+		server.revision = rev.Revision
+		server.revisions = append(server.revisions, res)
+
+		if len(server.revisions) > contentRevisionHistory {
+			server.revisions = server.revisions[len(server.revisions)-contentRevisionHistory:]
+		}
+
+		ContentMutex.Unlock()
+
+		notifyContentChange(server)
+	}
+
+	if changed {
+		saveContentRevisions()
+	}
+}
+
+// Returns the content of the server at its current revision. Before the first content sync the
+// revision is 0 and the content is taken from the content sources.
+// Must be called with locked content mutex.
+func currentContent(server *Server) ContentResponse {
+	if len(server.revisions) == 0 {
+		return buildContentResponse(server)
+	}
+
+	return server.revisions[len(server.revisions)-1]
+}
+
+// Returns the content of the server at a previous revision, if still known.
+// Must be called with locked content mutex.
+func previousContent(server *Server, revision int64) (ContentResponse, bool) {
+	for _, res := range server.revisions {
+		if res.Revision == revision {
+			return res, true
+		}
+	}
+
+	return ContentResponse{}, false
+}
+
+func buildContentDelta(from, to ContentResponse) ContentDeltaResponse {
+	return ContentDeltaResponse{Revision:to.Revision, Since:from.Revision, Serial:to.Serial,
+		ContentImages:diffContentLists(from.ContentImages, to.ContentImages),
+		Content2Images:diffContentLists(from.Content2Images, to.Content2Images),
+		Content3Images:diffContentLists(from.Content3Images, to.Content3Images),
+		MixinImages:diffContentLists(from.MixinImages, to.MixinImages),
+		Ticker:diffContentLists(from.Ticker, to.Ticker),
+		TickerDefault:to.TickerDefault}
+}
+
+// Computes the changes turning the old into the new content list. Items kept in their relative order are
+// not reported. The new list is obtained by removing the removed and moved items from the old list
+// (old indices) and inserting the added and moved items at their new indices in ascending order.
+func diffContentLists(old, new []Content) ContentListDelta {
+	delta := ContentListDelta{Added: []ContentDeltaItem{}, Removed: []int{}, Moved: []ContentDeltaMove{}}
+
+	positions := make(map[Content][]int)
+
+	for i, c := range old {
+		positions[c] = append(positions[c], i)
+	}
+
+	matched := make([]bool, len(old))
+	var pairs []ContentDeltaMove
+	last := -1
+
+	for j, c := range new {
+		if p := positions[c]; len(p) > 0 {
+			// of duplicate items prefer the first one keeping the order of the previously matched items
+			k := sort.SearchInts(p, last+1)
+			if k == len(p) {
+				k = 0
+			}
+
+			i := p[k]
+			positions[c] = append(p[:k:k], p[k+1:]...)
+			matched[i] = true
+			last = i
+			pairs = append(pairs, ContentDeltaMove{From: i, To: j})
+		} else {
+			delta.Added = append(delta.Added, ContentDeltaItem{Index: j, Content: c})
+		}
+	}
+
+	for i := range old {
+		if !matched[i] {
+			delta.Removed = append(delta.Removed, i)
+		}
+	}
+
+	stable := longestIncreasingRun(pairs)
+
+	for k, p := range pairs {
+		if !stable[k] {
+			delta.Moved = append(delta.Moved, p)
+		}
+	}
+
+	return delta
+}
+
+// Marks the pairs forming a longest subsequence with increasing old indices. These items keep their
+// relative order, all other pairs are moved.
+func longestIncreasingRun(pairs []ContentDeltaMove) []bool {
+	var tails []int
+	prev := make([]int, len(pairs))
+
+	for k, p := range pairs {
+		n := sort.Search(len(tails), func(i int) bool { return pairs[tails[i]].From >= p.From })
+
+		if n > 0 {
+			prev[k] = tails[n-1]
+		} else {
+			prev[k] = -1
+		}
+
+		if n == len(tails) {
+			tails = append(tails, k)
+		} else {
+			tails[n] = k
+		}
+	}
+
+	stable := make([]bool, len(pairs))
+
+	if len(tails) > 0 {
+		for k := tails[len(tails)-1]; k >= 0; k = prev[k] {
+			stable[k] = true
+		}
+	}
+
+	return stable
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Applies a content list delta as documented: removes the removed and moved items from the old list
+// and inserts the added and moved items at their new indices in ascending order.
+func applyContentDelta(old []Content, delta ContentListDelta) []Content {
+	drop := make(map[int]bool)
+	for _, i := range delta.Removed {
+		drop[i] = true
+	}
+	for _, m := range delta.Moved {
+		drop[m.From] = true
+	}
+
+	var res []Content
+	for i, c := range old {
+		if !drop[i] {
+			res = append(res, c)
+		}
+	}
+
+	type insert struct {
+		index int
+		content Content
+	}
+
+	var inserts []insert
+	for _, a := range delta.Added {
+		inserts = append(inserts, insert{a.Index, a.Content})
+	}
+	for _, m := range delta.Moved {
+		inserts = append(inserts, insert{m.To, old[m.From]})
+	}
+
+	sort.Slice(inserts, func(a, b int) bool { return inserts[a].index < inserts[b].index })
+
+	for _, ins := range inserts {
+		res = append(res, Content{})
+		copy(res[ins.index+1:], res[ins.index:])
+		res[ins.index] = ins.content
+	}
+
+	return res
+}
+
+func contentList(names ...string) []Content {
+	res := []Content{}
+	for _, n := range names {
+		res = append(res, Content{Type: ContentTypeImage, RepoUrl: n})
+	}
+	return res
+}
+
+func TestDiffContentLists(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     []Content
+		new     []Content
+		added   int
+		removed int
+		moved   int
+	}{
+		{"unchanged", contentList("a", "b", "c"), contentList("a", "b", "c"), 0, 0, 0},
+		{"both empty", contentList(), contentList(), 0, 0, 0},
+		{"from empty", contentList(), contentList("a", "b"), 2, 0, 0},
+		{"to empty", contentList("a", "b"), contentList(), 0, 2, 0},
+		{"add front", contentList("a", "b"), contentList("x", "a", "b"), 1, 0, 0},
+		{"add middle and end", contentList("a", "b"), contentList("a", "x", "b", "y"), 2, 0, 0},
+		{"remove", contentList("a", "b", "c"), contentList("a", "c"), 0, 1, 0},
+		{"move first to end", contentList("a", "b", "c", "d"), contentList("b", "c", "d", "a"), 0, 0, 1},
+		{"move last to front", contentList("a", "b", "c", "d"), contentList("d", "a", "b", "c"), 0, 0, 1},
+		{"swap", contentList("a", "b"), contentList("b", "a"), 0, 0, 1},
+		{"reverse", contentList("a", "b", "c", "d"), contentList("d", "c", "b", "a"), 0, 0, 3},
+		{"duplicates kept", contentList("a", "a", "b"), contentList("a", "a", "b"), 0, 0, 0},
+		{"duplicate added", contentList("a", "b"), contentList("a", "b", "a"), 1, 0, 0},
+		{"duplicate removed", contentList("a", "b", "a"), contentList("b", "a"), 0, 1, 0},
+		{"duplicates moved", contentList("a", "b", "a", "c"), contentList("c", "a", "a", "b"), 0, 0, 2},
+		{"duplicate moved", contentList("a", "b", "a"), contentList("b", "a", "a"), 0, 0, 1},
+		{"mixed", contentList("a", "b", "c", "d", "e"), contentList("e", "b", "x", "d", "a"), 1, 1, 2},
+	}
+
+	for _, tc := range tests {
+		delta := diffContentLists(tc.old, tc.new)
+
+		if len(delta.Added) != tc.added || len(delta.Removed) != tc.removed || len(delta.Moved) != tc.moved {
+			t.Errorf("%s: added %d, removed %d, moved %d; want %d, %d, %d", tc.name,
+				len(delta.Added), len(delta.Removed), len(delta.Moved), tc.added, tc.removed, tc.moved)
+		}
+
+		got := applyContentDelta(tc.old, delta)
+		if got == nil {
+			got = []Content{}
+		}
+
+		if !reflect.DeepEqual(got, tc.new) {
+			t.Errorf("%s: applying delta gives %v, want %v", tc.name, got, tc.new)
+		}
+	}
+}
+
+func TestDiffContentListsText(t *testing.T) {
+	old := []Content{{Type: ContentTypeText, Text: "a"}, {Type: ContentTypeText, Text: "b"}}
+	new := []Content{{Type: ContentTypeText, Text: "b"}, {Type: ContentTypeText, Text: "a", QrUrl: "qr.png"}}
+
+	delta := diffContentLists(old, new)
+
+	// an item with changed fields is a different item
+	if len(delta.Added) != 1 || len(delta.Removed) != 1 || len(delta.Moved) != 0 {
+		t.Errorf("delta = %+v", delta)
+	}
+
+	if got := applyContentDelta(old, delta); !reflect.DeepEqual(got, new) {
+		t.Errorf("applying delta gives %v, want %v", got, new)
+	}
+}
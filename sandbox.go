@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errInvalidPath = errors.New("invalid path")
+var errSymlink = errors.New("symbolic link not allowed")
+var errNotAFile = errors.New("not a regular file")
+
+// Checks a slash separated path relative to a served root directory and returns it in cleaned form.
+// Paths containing ".." segments, dot-files or dot-directories, NUL characters or backslashes are rejected.
+func sanitizeServedPath(path string) (string, error) {
+	if strings.ContainsAny(path, "\x00\\") {
+		return "", errInvalidPath
+	}
+
+	var segments []string
+
+	for _, s := range strings.Split(path, "/") {
+		if s == "" {
+			continue
+		}
+		if strings.HasPrefix(s, ".") {
+			return "", errInvalidPath
+		}
+		segments = append(segments, s)
+	}
+
+	if len(segments) == 0 {
+		return "", errInvalidPath
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// Checks that no path component below the root directory is a symbolic link.
+func checkNoSymlinks(root, path string) error {
+	current := root
+
+	for _, s := range strings.Split(path, "/") {
+		current = filepath.Join(current, s)
+
+		fi, err := os.Lstat(current)
+
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return errSymlink
+		}
+	}
+
+	return nil
+}
+
+// Opens a regular file located below the root directory. The path is relative to the root directory
+// using slashes as separator. Returns the opened file and the cleaned path.
+func openSandboxed(root, path string) (*os.File, os.FileInfo, string, error) {
+	name, err := sanitizeServedPath(path)
+
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if !g_config.FollowSymlinks {
+		if err = checkNoSymlinks(root, name); err != nil {
+			return nil, nil, "", err
+		}
+	}
+
+	fullPath := filepath.Join(root, filepath.FromSlash(name))
+
+	// defense in depth: the joined path must not leave the root directory
+	rel, err := filepath.Rel(root, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, nil, "", errInvalidPath
+	}
+
+	fp, err := os.Open(fullPath)
+
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	fi, err := fp.Stat()
+
+	if err != nil {
+		fp.Close()
+		return nil, nil, "", err
+	}
+
+	if !fi.Mode().IsRegular() {
+		fp.Close()
+		return nil, nil, "", errNotAFile
+	}
+
+	return fp, fi, name, nil
+}
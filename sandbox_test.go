@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Creates a served root with a regular file, a dot-file, a dot-directory and a sub-directory,
+// next to a secret file outside of the root.
+func setupSandbox(t *testing.T) (string, string) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+
+	for _, dir := range []string{root, filepath.Join(root, "dir"), filepath.Join(root, ".cache", "x")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		filepath.Join(base, "secret.txt"):               "secret",
+		filepath.Join(root, "index.html"):               "<html></html>",
+		filepath.Join(root, "dir", "a.txt"):             "a",
+		filepath.Join(root, ".revisions.json"):          "{}",
+		filepath.Join(root, ".cache", "x", "entry.png"): "png",
+	}
+
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return base, root
+}
+
+func TestSanitizeServedPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"index.html", "index.html", true},
+		{"dir/a.txt", "dir/a.txt", true},
+		{"/dir//a.txt", "dir/a.txt", true},
+		{"../etc/passwd", "", false},
+		{"a/../../b", "", false},
+		{"..", "", false},
+		{".", "", false},
+		{"", "", false},
+		{".revisions.json", "", false},
+		{".cache/x/entry.png", "", false},
+		{"dir/.hidden", "", false},
+		{"index.html\x00.png", "", false},
+		{"..\\secret.txt", "", false},
+		{"dir\\a.txt", "", false},
+	}
+
+	for _, tc := range tests {
+		got, err := sanitizeServedPath(tc.path)
+
+		if tc.ok && (err != nil || got != tc.want) {
+			t.Errorf("sanitizeServedPath(%q) = %q, %v; want %q", tc.path, got, err, tc.want)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("sanitizeServedPath(%q) = %q; want error", tc.path, got)
+		}
+	}
+}
+
+func TestOpenSandboxed(t *testing.T) {
+	base, root := setupSandbox(t)
+
+	if err := os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(base, filepath.Join(root, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(follow bool) { g_config.FollowSymlinks = follow }(g_config.FollowSymlinks)
+
+	g_config.FollowSymlinks = false
+
+	for _, path := range []string{"../secret.txt", "a/../../secret.txt", "..", "dir", ".revisions.json",
+		".cache/x/entry.png", "link.txt", "linkdir/secret.txt", "missing.txt"} {
+		if fp, _, _, err := openSandboxed(root, path); err == nil {
+			fp.Close()
+			t.Errorf("openSandboxed(%q): want error", path)
+		}
+	}
+
+	fp, _, name, err := openSandboxed(root, "dir/a.txt")
+
+	if err != nil || name != "dir/a.txt" {
+		t.Fatalf("openSandboxed(dir/a.txt) = %q, %v", name, err)
+	}
+
+	fp.Close()
+
+	g_config.FollowSymlinks = true
+
+	fp, _, _, err = openSandboxed(root, "link.txt")
+
+	if err != nil {
+		t.Fatalf("openSandboxed(link.txt) with FollowSymlinks: %v", err)
+	}
+
+	fp.Close()
+}
+
+func TestServeFileTraversal(t *testing.T) {
+	_, root := setupSandbox(t)
+
+	defer func(follow bool) { g_config.FollowSymlinks = follow }(g_config.FollowSymlinks)
+
+	g_config.FollowSymlinks = false
+
+	server := &Server{config: ServerConfig{AppRoot: root}}
+
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"/index.html", http.StatusOK},
+		{"/dir/a.txt", http.StatusOK},
+		{"/../secret.txt", http.StatusNotFound},
+		{"/%2e%2e/secret.txt", http.StatusNotFound},
+		{"/dir/%2e%2e/%2e%2e/secret.txt", http.StatusNotFound},
+		{"/%2e%2e%2fsecret.txt", http.StatusNotFound},
+		{"/..%5csecret.txt", http.StatusNotFound},
+		{"/index.html%00.png", http.StatusNotFound},
+		{"/.revisions.json", http.StatusNotFound},
+		{"/%2erevisions.json", http.StatusNotFound},
+		{"/.cache/x/entry.png", http.StatusNotFound},
+		{"/dir", http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		resp := httptest.NewRecorder()
+
+		serveFile(server, "/", root, resp, req)
+
+		if resp.Code != tc.code {
+			t.Errorf("GET %s: status %d, want %d", tc.url, resp.Code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SlideWidth = 1920
+const SlideHeight = 1080
+
+const slideMargin = 96
+const slideTitleHeight = 240
+const slideTitleGap = 48
+
+const slideTitleMaxFontSize = 120.0
+const slideTitleMinFontSize = 40.0
+const slideBodyMaxFontSize = 80.0
+const slideBodyMinFontSize = 24.0
+
+type SlideTheme struct {
+	background      image.Image
+	backgroundColor color.Color
+	textColor       color.Color
+	titleFont       *opentype.Font
+	bodyFont        *opentype.Font
+}
+
+// Theme used for rendering announcements during the current content sync and the stamp identifying it.
+var slideTheme *SlideTheme
+var slideThemeStamp string
+
+// Announcement slides are only rendered if a theme directory is configured, otherwise text files in
+// content and dia show directories are ignored.
+func announcementsEnabled() bool {
+	return g_config.SlideThemeDir != ""
+}
+
+func parseHexColor(s string) (color.Color, error) {
+	s = strings.TrimPrefix(s, "#")
+
+	if len(s) != 6 {
+		return nil, fmt.Errorf("invalid color: %s", s)
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color: %s", s)
+	}
+
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+func themePath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(g_config.SlideThemeDir, name)
+}
+
+func loadFont(name string, fallback []byte) *opentype.Font {
+	data := fallback
+
+	if name != "" {
+		d, err := ioutil.ReadFile(themePath(name))
+		if err != nil {
+			Error("loadFont: failed to read font file: %s: %s", name, err.Error())
+		} else {
+			data = d
+		}
+	}
+
+	f, err := opentype.Parse(data)
+
+	if err != nil {
+		Error("loadFont: failed to parse font: %s: %s", name, err.Error())
+		f, _ = opentype.Parse(fallback)
+	}
+
+	return f
+}
+
+// Builds a stamp from the theme settings and the modification times of the theme files. A changed stamp
+// means that announcements must be rendered again.
+func buildSlideThemeStamp() string {
+	stamp := fmt.Sprintf("%s|%s|%s|%s|%s|%s", g_config.SlideThemeDir, g_config.SlideBackground, g_config.SlideTitleFont,
+		g_config.SlideBodyFont, g_config.SlideTextColor, g_config.SlideBackgroundColor)
+
+	for _, name := range []string{g_config.SlideBackground, g_config.SlideTitleFont, g_config.SlideBodyFont} {
+		if name == "" {
+			continue
+		}
+
+		if fi, err := os.Stat(themePath(name)); err == nil {
+			stamp += fmt.Sprintf("|%s-%d", fi.ModTime().Format(time.RFC3339Nano), fi.Size())
+		}
+	}
+
+	return hashData([]byte(stamp))
+}
+
+// Reloads the slide theme if the theme files or settings changed. Called once per content sync.
+func updateSlideTheme() {
+	if !announcementsEnabled() {
+		return
+	}
+
+	stamp := buildSlideThemeStamp()
+
+	if slideTheme != nil && stamp == slideThemeStamp {
+		return
+	}
+
+	Info(0, "Loading slide theme: %s", g_config.SlideThemeDir)
+
+	slideTheme = loadSlideTheme()
+	slideThemeStamp = stamp
+}
+
+func loadSlideTheme() *SlideTheme {
+	theme := new(SlideTheme)
+
+	var err error
+
+	theme.textColor, err = parseHexColor(g_config.SlideTextColor)
+	if err != nil {
+		Error("loadSlideTheme: SlideTextColor: %s", err.Error())
+		theme.textColor = color.White
+	}
+
+	theme.backgroundColor, err = parseHexColor(g_config.SlideBackgroundColor)
+	if err != nil {
+		Error("loadSlideTheme: SlideBackgroundColor: %s", err.Error())
+		theme.backgroundColor = color.Black
+	}
+
+	theme.titleFont = loadFont(g_config.SlideTitleFont, gobold.TTF)
+	theme.bodyFont = loadFont(g_config.SlideBodyFont, goregular.TTF)
+
+	if g_config.SlideThemeDir != "" && g_config.SlideBackground != "" {
+		path := themePath(g_config.SlideBackground)
+
+		fp, err := os.Open(path)
+		if err != nil {
+			Error("loadSlideTheme: failed to open background image: %s", path)
+		} else {
+			theme.background, _, err = image.Decode(fp)
+			if err != nil {
+				Error("loadSlideTheme: failed to decode background image: %s: %s", path, err.Error())
+			}
+			fp.Close()
+		}
+	}
+
+	return theme
+}
+
+// Splits paragraphs into lines not exceeding the given width. Returns false if a single word does not fit.
+func wrapText(face font.Face, paragraphs []string, width int) ([]string, bool) {
+	var lines []string
+	fits := true
+	maxWidth := fixed.I(width)
+
+	for _, p := range paragraphs {
+		line := ""
+
+		for _, word := range strings.Fields(p) {
+			if font.MeasureString(face, word) > maxWidth {
+				fits = false
+			}
+
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+
+			if line != "" && font.MeasureString(face, candidate) > maxWidth {
+				lines = append(lines, line)
+				line = word
+			} else {
+				line = candidate
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, fits
+}
+
+// Determines the largest font size for which the wrapped text fits into the given box.
+func fitText(f *opentype.Font, paragraphs []string, maxSize, minSize float64, width, height int) (font.Face, []string) {
+	for size := maxSize; ; size *= 0.9 {
+		if size < minSize {
+			size = minSize
+		}
+
+		face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			Error("fitText: failed to create font face: %s", err.Error())
+			return nil, nil
+		}
+
+		lines, fits := wrapText(face, paragraphs, width)
+
+		if (fits && len(lines)*face.Metrics().Height.Ceil() <= height) || size == minSize {
+			return face, lines
+		}
+
+		face.Close()
+	}
+}
+
+// Draws text lines into the given box, returns the height used.
+func drawText(dst draw.Image, face font.Face, lines []string, col color.Color, x, y, height int) int {
+	lineHeight := face.Metrics().Height.Ceil()
+	ascent := face.Metrics().Ascent.Ceil()
+
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(col), Face: face}
+
+	used := 0
+	for _, line := range lines {
+		if used+lineHeight > height {
+			break
+		}
+		d.Dot = fixed.P(x, y+used+ascent)
+		d.DrawString(line)
+		used += lineHeight
+	}
+
+	return used
+}
+
+// Renders an announcement consisting of a title and body paragraphs onto the slide theme.
+func renderAnnouncement(theme *SlideTheme, title string, body []string) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, SlideWidth, SlideHeight))
+
+	draw.Draw(img, img.Bounds(), image.NewUniform(theme.backgroundColor), image.Point{}, draw.Src)
+
+	if theme.background != nil {
+		drawCover(img, theme.background)
+	}
+
+	width := SlideWidth - 2*slideMargin
+	y := slideMargin
+
+	if title != "" {
+		face, lines := fitText(theme.titleFont, []string{title}, slideTitleMaxFontSize, slideTitleMinFontSize, width, slideTitleHeight)
+		if face != nil {
+			y += drawText(img, face, lines, theme.textColor, slideMargin, y, slideTitleHeight) + slideTitleGap
+			face.Close()
+		}
+	}
+
+	if len(body) > 0 {
+		height := SlideHeight - slideMargin - y
+		face, lines := fitText(theme.bodyFont, body, slideBodyMaxFontSize, slideBodyMinFontSize, width, height)
+		if face != nil {
+			drawText(img, face, lines, theme.textColor, slideMargin, y, height)
+			face.Close()
+		}
+	}
+
+	return img
+}
+
+// Parses an announcement file: the first non-empty line is the title, the following lines form the body.
+// Body paragraphs are separated by empty lines.
+func parseAnnouncementFile(path string) (string, []string, bool) {
+	text, ok := readTextFile(path)
+
+	if !ok {
+		return "", nil, false
+	}
+
+	title := ""
+	var body []string
+	para := ""
+
+	for _, s := range strings.Split(text, "\n") {
+		s = strings.TrimSpace(s)
+
+		if title == "" {
+			title = s
+			continue
+		}
+
+		if s == "" {
+			if para != "" {
+				body = append(body, para)
+				para = ""
+			}
+			continue
+		}
+
+		if para != "" {
+			para += " "
+		}
+		para += s
+	}
+
+	if para != "" {
+		body = append(body, para)
+	}
+
+	return title, body, true
+}
+
+// Renders an announcement file located in the repository to a PNG image, which is stored in the repository.
+// Returns the name of the image repository file or an empty string on error.
+func importAnnouncementFile(repoFile string) string {
+	title, body, ok := parseAnnouncementFile(filepath.Join(g_config.RepoRoot, repoFile))
+
+	if !ok {
+		return ""
+	}
+
+	img := renderAnnouncement(slideTheme, title, body)
+
+	buf := new(bytes.Buffer)
+
+	err := png.Encode(buf, img)
+
+	if err != nil {
+		Error("importAnnouncementFile: failed to encode image: %s: %s", repoFile, err.Error())
+		return ""
+	}
+
+	return storeInRepo(buf.Bytes(), ".png")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Image rendition parameters requested by clients of a server.
+type RenditionProfile struct {
+	server   *Server
+	query    string
+	accept   string
+	width    uint
+	height   uint
+	count    int
+	lastSeen time.Time
+}
+
+// Query parameters which determine an image rendition besides its size.
+var renditionQueryKeys = []string{"fit", "gravity", "format"}
+
+const renditionProfileExpiry = 7 * 24 * time.Hour
+
+// Maximum number of recorded rendition profiles of all servers.
+const maxRenditionProfiles = 256
+
+var renditionProfiles = make(map[string]*RenditionProfile)
+var renditionProfileMutex sync.Mutex
+
+// Records the rendition parameters of an image request for warming up the caches when new images are published.
+// Width and height are the rendition size after applying the rendition policy.
+func recordRenditionRequest(server *Server, req *http.Request, width, height uint) {
+	if g_config.WarmupProfiles <= 0 {
+		return
+	}
+
+	query := req.URL.Query()
+	normalized := url.Values{}
+
+	for _, k := range renditionQueryKeys {
+		if v := query.Get(k); v != "" {
+			normalized.Set(k, v)
+		}
+	}
+
+	accept := ""
+	if strings.Contains(req.Header.Get("Accept"), "image/webp") {
+		accept = "image/webp"
+	}
+
+	q := normalized.Encode()
+	key := fmt.Sprintf("%d/%dx%d?%s|%s", server.index, width, height, q, accept)
+
+	renditionProfileMutex.Lock()
+	defer renditionProfileMutex.Unlock()
+
+	p := renditionProfiles[key]
+
+	if p == nil {
+		if len(renditionProfiles) >= maxRenditionProfiles {
+			evictRenditionProfile()
+		}
+
+		p = &RenditionProfile{server: server, query: q, accept: accept, width: width, height: height}
+		renditionProfiles[key] = p
+
+		Info(1, "New rendition profile: server %d: %dx%d %s %s", server.index, width, height, q, accept)
+	}
+
+	p.count++
+	p.lastSeen = time.Now()
+}
+
+// Removes expired profiles or, if none expired, the least frequently requested profile, so that clients
+// requesting many different renditions cannot displace frequently requested ones.
+// Must be called with locked rendition profile mutex.
+func evictRenditionProfile() {
+	var evictKey string
+	var evict *RenditionProfile
+
+	for key, p := range renditionProfiles {
+		if time.Since(p.lastSeen) > renditionProfileExpiry {
+			delete(renditionProfiles, key)
+			continue
+		}
+
+		if evict == nil || p.count < evict.count || (p.count == evict.count && p.lastSeen.Before(evict.lastSeen)) {
+			evictKey = key
+			evict = p
+		}
+	}
+
+	if len(renditionProfiles) >= maxRenditionProfiles && evict != nil {
+		delete(renditionProfiles, evictKey)
+	}
+}
+
+// Returns the most frequently requested rendition profiles of servers using the content source.
+func warmupProfiles(src *ContentSource) []*RenditionProfile {
+	renditionProfileMutex.Lock()
+	defer renditionProfileMutex.Unlock()
+
+	var res []*RenditionProfile
+
+	for key, p := range renditionProfiles {
+		if time.Since(p.lastSeen) > renditionProfileExpiry {
+			delete(renditionProfiles, key)
+			continue
+		}
+
+		s := p.server
+		if s.content1 == src || s.content2 == src || s.content3 == src || s.dias == src {
+			res = append(res, p)
+		}
+	}
+
+	sort.Slice(res, func(a, b int) bool { return res[a].count > res[b].count })
+
+	if len(res) > g_config.WarmupProfiles {
+		res = res[:g_config.WarmupProfiles]
+	}
+
+	return res
+}
+
+// Pre-renders the images of a new content list for all rendition profiles requested by clients.
+func warmupRenditions(src *ContentSource, content []Content) {
+	if g_config.WarmupProfiles <= 0 {
+		return
+	}
+
+	profiles := warmupProfiles(src)
+
+	if len(profiles) == 0 {
+		return
+	}
+
+	start := time.Now()
+	n := 0
+
+	for _, c := range content {
+		if c.Type != ContentTypeImage || !isImageFile(c.RepoUrl) {
+			continue
+		}
+
+		for _, p := range profiles {
+			if warmupRendition(p, c.RepoUrl) {
+				n++
+			}
+		}
+	}
+
+	Info(0, "Warmed up %d image renditions in %.1f s", n, time.Since(start).Seconds())
+}
+
+func warmupRendition(p *RenditionProfile, name string) bool {
+	path := filepath.Join(g_config.RepoRoot, name)
+
+	fp, err := os.Open(path)
+
+	if err != nil {
+		Error("warmupRendition: failed to open file: %s", path)
+		return false
+	}
+
+	defer fp.Close()
+
+	req := &http.Request{URL: &url.URL{RawQuery: p.query}, Header: http.Header{}}
+	if p.accept != "" {
+		req.Header.Set("Accept", p.accept)
+	}
+
+	opts, width, height, err := prepareRendition(p.server, RepUrlRoot, name, fp, p.width, p.height, req)
+
+	if err != nil {
+		Error("warmupRendition: %s: %s: %s", name, p.query, err.Error())
+		return false
+	}
+
+	_, err = getSizedImage(context.Background(), RepUrlRoot, name, fp, width, height, opts, "")
+
+	if err != nil {
+		Error("warmupRendition: %s: %s: %s", name, p.query, err.Error())
+		return false
+	}
+
+	return true
+}
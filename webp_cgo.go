@@ -0,0 +1,16 @@
+//go:build cgo
+
+package main
+
+import (
+	"github.com/chai2010/webp"
+	"image"
+	"io"
+)
+
+// WebP encoding requires cgo, see webp_nocgo.go for builds without cgo.
+const webpSupported = true
+
+func encodeWebp(w io.Writer, img image.Image) error {
+	return webp.Encode(w, img, &webp.Options{Quality: float32(g_config.WebpQuality)})
+}
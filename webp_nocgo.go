@@ -0,0 +1,16 @@
+//go:build !cgo
+
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// Without cgo no WebP encoder is available. Resized images are delivered as JPEG or PNG instead.
+const webpSupported = false
+
+func encodeWebp(w io.Writer, img image.Image) error {
+	return errors.New("WebP encoding not supported")
+}